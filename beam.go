@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strings"
+)
+
+// how candidates are generated from seeds
+const (
+	walkGeneration = "walk" // random walks (see WalkMode)
+	beamGeneration = "beam" // beam search for the most likely responses
+)
+
+// hypothesis is a partial response kept in the beam
+type hypothesis struct {
+	words   []string // seed chain and generated words
+	logProb float64  // sum of log probabilities of transitions
+	steps   int      // number of transitions
+	done    bool     // reached stop (or a chain without followers)
+}
+
+// candidateBranches returns up to n response candidates starting at the chain of words using GenerationMode
+// (words joined with spaces, before postprocess)
+func candidateBranches(ctx context.Context, words []string, n int, salient []string) []string {
+	if config.GenerationMode == beamGeneration {
+		return beamSearch(ctx, words, n, salient)
+	}
+	return randomBranches(ctx, words, n)
+}
+
+// beamSearch keeps BeamWidth best hypotheses (see beamScore), extending each one
+// with BeamBranching most frequent followers. Followers of all hypotheses are fetched
+// in one round-trip, so a response costs at most MaxChainLength round-trips.
+// Returns up to n best finished hypotheses.
+func beamSearch(ctx context.Context, words []string, n int, salient []string) []string {
+	corpus := pool.Get()
+	defer corpus.Close()
+
+	chain := append([]string{}, words[:config.ChainLength]...)
+	wordsLeft := minWords(chain, settingsFrom(ctx))
+	beam := []hypothesis{{words: chain}}
+	var finished []hypothesis
+
+	for step := 0; step < int(config.MaxChainLength) && len(beam) > 0 && ctx.Err() == nil; step++ {
+		orders := make([]int, len(beam))
+		for i, h := range beam {
+			orders[i] = sendFollowers(corpus, h.words)
+		}
+		if err := corpus.Flush(); err != nil {
+			redisErr(err)
+			break
+		}
+
+		var next []hypothesis
+		failed := false
+		for i, h := range beam {
+			followers, err := receiveFollowers(corpus, orders[i])
+			if err != nil {
+				redisErr(err)
+				failed = true
+				break
+			}
+			for _, e := range expand(h, followers, int64(step) >= wordsLeft, int(config.BeamBranching)) {
+				if e.done {
+					finished = append(finished, e)
+				} else {
+					next = append(next, e)
+				}
+			}
+		}
+		if failed {
+			break
+		}
+		beam = bestHypotheses(next, salient, int(config.BeamWidth))
+	}
+	// hypotheses cut at MaxChainLength are responses as well (like in random walks)
+	finished = bestHypotheses(append(finished, beam...), salient, n)
+
+	branches := make([]string, 0, len(finished))
+	for _, h := range finished {
+		branches = append(branches, strings.Join(h.words, " "))
+	}
+	return branches
+}
+
+// expand returns hypotheses following h with up to branching most frequent followers,
+// stop (allowed if canStop or there is nothing else) finishes the hypothesis
+func expand(h hypothesis, followers map[string]int, canStop bool, branching int) []hypothesis {
+	if len(followers) == 0 {
+		h.done = true
+		return []hypothesis{h}
+	}
+
+	var (
+		candidates []frequency
+		total      int
+	)
+	for word, count := range followers {
+		total += count
+		if canStop || !isEmpty(word) || len(followers) == 1 {
+			candidates = append(candidates, frequency{word: word, count: count})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].count != candidates[j].count {
+			return candidates[i].count > candidates[j].count
+		}
+		return candidates[i].word < candidates[j].word
+	})
+	if branching > 0 && len(candidates) > branching {
+		candidates = candidates[:branching]
+	}
+
+	expanded := make([]hypothesis, 0, len(candidates))
+	for _, c := range candidates {
+		e := hypothesis{
+			words:   h.words,
+			logProb: h.logProb + math.Log(float64(c.count)/float64(total)),
+			steps:   h.steps + 1,
+			done:    isEmpty(c.word),
+		}
+		if !e.done {
+			e.words = append(append(make([]string, 0, len(h.words)+1), h.words...), c.word)
+		}
+		expanded = append(expanded, e)
+	}
+	return expanded
+}
+
+// beamScore combines the likelihood of the hypothesis (mean log probability of its transitions)
+// with overlap and length scorers weighted by ScoreWeights
+func beamScore(h hypothesis, salient []string) float64 {
+	score := 0.0
+	if h.steps > 0 {
+		score = h.logProb / float64(h.steps)
+	}
+	tokens := withoutMarkers(h.words)
+	s := &scoring{salient: salient}
+	return score + config.ScoreWeights["overlap"]*overlapScore(tokens, s) + config.ScoreWeights["length"]*lengthScore(tokens, s)
+}
+
+// bestHypotheses returns up to n hypotheses with the highest beamScore
+func bestHypotheses(hypotheses []hypothesis, salient []string, n int) []hypothesis {
+	scores := make(map[string]float64, len(hypotheses))
+	key := func(h hypothesis) string {
+		return strings.Join(h.words, separator)
+	}
+	for _, h := range hypotheses {
+		scores[key(h)] = beamScore(h, salient)
+	}
+	sort.SliceStable(hypotheses, func(i, j int) bool {
+		a, b := key(hypotheses[i]), key(hypotheses[j])
+		if scores[a] != scores[b] {
+			return scores[a] > scores[b]
+		}
+		return a < b
+	})
+	if len(hypotheses) > n {
+		hypotheses = hypotheses[:n]
+	}
+	return hypotheses
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestExpand(t *testing.T) {
+	h := hypothesis{words: []string{start, "the"}}
+	followers := map[string]int{"cat": 5, "dog": 3, "fish": 1, stop: 1}
+
+	expanded := expand(h, followers, false, 2)
+	if len(expanded) != 2 || expanded[0].words[2] != "cat" || expanded[1].words[2] != "dog" {
+		t.Errorf("expand should follow the most frequent followers: %+v", expanded)
+	}
+	if expanded[0].steps != 1 || expanded[0].logProb <= expanded[1].logProb {
+		t.Errorf("more frequent followers should be more likely: %+v", expanded)
+	}
+	if !reflect.DeepEqual(h.words, []string{start, "the"}) {
+		t.Error("expand should not modify the original hypothesis")
+	}
+
+	expanded = expand(h, followers, true, 0)
+	done := 0
+	for _, e := range expanded {
+		if e.done {
+			done++
+			if !reflect.DeepEqual(e.words, h.words) {
+				t.Errorf("stop should finish the hypothesis without adding words: %v", e.words)
+			}
+		}
+	}
+	if len(expanded) != 4 || done != 1 {
+		t.Errorf("expand should follow every follower including stop when it is allowed: %+v", expanded)
+	}
+	if expanded = expand(h, map[string]int{stop: 2}, false, 2); len(expanded) != 1 || !expanded[0].done {
+		t.Errorf("stop should be followed when there is nothing else: %+v", expanded)
+	}
+	if expanded = expand(h, nil, false, 2); len(expanded) != 1 || !expanded[0].done {
+		t.Errorf("hypothesis without followers should be finished: %+v", expanded)
+	}
+}
+
+func TestBestHypotheses(t *testing.T) {
+	weightsOrig := config.ScoreWeights
+	defer func() { config.ScoreWeights = weightsOrig }()
+	config.ScoreWeights = map[string]float64{"overlap": 1}
+
+	likely := hypothesis{words: []string{"the", "cat"}, logProb: -0.1, steps: 1}
+	unlikely := hypothesis{words: []string{"the", "dog"}, logProb: -3, steps: 1}
+	salient := hypothesis{words: []string{"the", "kubernetes"}, logProb: -1, steps: 1}
+
+	best := bestHypotheses([]hypothesis{unlikely, likely}, nil, 1)
+	if len(best) != 1 || best[0].words[1] != "cat" {
+		t.Errorf("bestHypotheses should prefer likely hypotheses: %+v", best)
+	}
+	best = bestHypotheses([]hypothesis{likely, salient, unlikely}, []string{"kubernetes"}, 2)
+	if len(best) != 2 || best[0].words[1] != "kubernetes" || best[1].words[1] != "cat" {
+		t.Errorf("bestHypotheses should prefer hypotheses with salient words: %+v", best)
+	}
+}
+
+func TestBeamSearchCountsFollowers(t *testing.T) {
+	defer scratchCorpus(t)()
+	samplingOrig, overridesOrig, generationOrig := config.Sampling, config.ChannelSettings, config.GenerationMode
+	defer func() {
+		config.Sampling, config.ChannelSettings, config.GenerationMode = samplingOrig, overridesOrig, generationOrig
+	}()
+	config.Sampling, config.ChannelSettings, config.GenerationMode = false, nil, beamGeneration
+
+	for i := 0; i < 3; i++ {
+		processInput("the cat sleeps", true)
+	}
+	processInput("the cat eats", true)
+
+	corpus := pool.Get()
+	defer corpus.Close()
+	words := parseInput("the cat")
+	chain := words[:len(words)-1] // without stop
+	frequencies, err := backoffFollowers(corpus, chain)
+	if err != nil || frequencies["sleeps"] != 3 || frequencies["eats"] != 1 {
+		t.Fatalf("beam search without sampling should see learned frequencies: %v %v", frequencies, err)
+	}
+	if expanded := expand(hypothesis{words: chain}, frequencies, false, 1); expanded[0].words[len(chain)] != "sleeps" {
+		t.Errorf("beam search should follow the most frequent follower: %+v", expanded)
+	}
+}
+
+// countingConn counts round-trips to Redis
+type countingConn struct {
+	redis.Conn
+	calls *int64
+}
+
+func (c countingConn) Do(command string, args ...interface{}) (interface{}, error) {
+	atomic.AddInt64(c.calls, 1)
+	return c.Conn.Do(command, args...)
+}
+
+func (c countingConn) Flush() error {
+	atomic.AddInt64(c.calls, 1)
+	return c.Conn.Flush()
+}
+
+// benchmarkGeneration reports the score of the best candidate (see scoreCandidates)
+// and the number of Redis round-trips needed to generate candidates from a single seed
+func benchmarkGeneration(b *testing.B, generation string, walk string) {
+	defer benchCorpus(b)()
+	generationOrig, walkOrig := config.GenerationMode, config.WalkMode
+	config.GenerationMode, config.WalkMode = generation, walk
+	defer func() { config.GenerationMode, config.WalkMode = generationOrig, walkOrig }()
+
+	var calls int64
+	dial := pool.Dial
+	pool.Dial = func() (redis.Conn, error) {
+		conn, err := dial()
+		if err != nil {
+			return nil, err
+		}
+		return countingConn{conn, &calls}, nil
+	}
+
+	input, seeds := processInput("the quick brown", false)
+	salient := salientWords(input)
+	var score float64
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		texts := candidateBranches(context.Background(), seeds[0], int(config.ChainsToTry), salient)
+
+		b.StopTimer()
+		before := atomic.LoadInt64(&calls)
+		var candidates []string
+		for _, text := range texts {
+			if !isEmpty(text) && !contains(candidates, text) && !contains(seeds[0], text) {
+				candidates = append(candidates, text)
+			}
+		}
+		if len(candidates) > 0 {
+			score += scoreCandidates(candidates, input, nil)[0].Score
+		}
+		atomic.StoreInt64(&calls, before) // scoring does not count
+		b.StartTimer()
+	}
+
+	roundTrips := float64(atomic.LoadInt64(&calls)) / float64(b.N)
+	score /= float64(b.N)
+	b.Logf("best score %.3f, %.1f round-trips per seed, %.4f score per round-trip", score, roundTrips, score/roundTrips)
+}
+
+func BenchmarkGenerationWalkClient(b *testing.B) {
+	benchmarkGeneration(b, walkGeneration, clientWalk)
+}
+
+func BenchmarkGenerationWalkServer(b *testing.B) {
+	benchmarkGeneration(b, walkGeneration, serverWalk)
+}
+
+func BenchmarkGenerationBeam(b *testing.B) {
+	benchmarkGeneration(b, beamGeneration, serverWalk)
+}
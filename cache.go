@@ -0,0 +1,131 @@
+package main
+
+import (
+	"container/list"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// followerCache is a bounded LRU cache of follower sets (members of chain keys),
+// it saves round-trips to Redis for hot keys like "i am" or "it is".
+// All methods are no-op on nil cache (caching is disabled).
+type followerCache struct {
+	mtx      sync.Mutex
+	capacity int
+	ttl      time.Duration
+	items    map[string]*list.Element
+	lru      *list.List // most recently used at the front
+
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+type cacheEntry struct {
+	key       string
+	followers []string
+	expires   time.Time
+}
+
+var followers *followerCache
+
+func newFollowerCache(capacity int, ttl time.Duration) *followerCache {
+	return &followerCache{
+		capacity: capacity,
+		ttl:      ttl,
+		items:    make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// get returns cached followers of the key (empty if key has none)
+func (c *followerCache) get(key string) ([]string, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	element, ok := c.items[key]
+	if ok && time.Now().After(element.Value.(*cacheEntry).expires) {
+		c.remove(element)
+		ok = false
+	}
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(element)
+	return element.Value.(*cacheEntry).followers, true
+}
+
+func (c *followerCache) put(key string, values []string) {
+	if c == nil {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	entry := &cacheEntry{key: key, followers: values, expires: time.Now().Add(c.ttl)}
+	if element, ok := c.items[key]; ok {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.items[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.capacity {
+		c.remove(c.lru.Back())
+		c.evictions++
+	}
+}
+
+// add refreshes cached followers after the value was added to the key in corpus
+func (c *followerCache) add(key string, value string) {
+	if c == nil {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	element, ok := c.items[key]
+	if !ok {
+		return
+	}
+	entry := element.Value.(*cacheEntry)
+	if contains(entry.followers, value) {
+		return
+	}
+	// copy, as old slice may be in use by readers
+	updated := make([]string, len(entry.followers), len(entry.followers)+1)
+	copy(updated, entry.followers)
+	element.Value = &cacheEntry{key: key, followers: append(updated, value), expires: entry.expires}
+}
+
+func (c *followerCache) remove(element *list.Element) {
+	c.lru.Remove(element)
+	delete(c.items, element.Value.(*cacheEntry).key)
+}
+
+func (c *followerCache) stats() map[string]interface{} {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	hitRate := 0.0
+	if total := c.hits + c.misses; total > 0 {
+		hitRate = float64(c.hits) / float64(total)
+	}
+	return map[string]interface{}{
+		"size":      c.lru.Len(),
+		"capacity":  c.capacity,
+		"hits":      c.hits,
+		"misses":    c.misses,
+		"evictions": c.evictions,
+		"hitRate":   hitRate,
+	}
+}
+
+// randomFollower mimics SRANDMEMBER: empty string when there are no followers
+func randomFollower(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[rand.Intn(len(values))]
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFollowerCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newFollowerCache(2, time.Minute)
+	c.put("a", []string{"1"})
+	c.put("b", []string{"2"})
+	c.get("a")
+	c.put("c", []string{"3"})
+
+	if _, ok := c.get("b"); ok {
+		t.Error("least recently used key should be evicted")
+	}
+	if values, ok := c.get("a"); !ok || values[0] != "1" {
+		t.Error("recently used key should stay in cache")
+	}
+	stats := c.stats()
+	if stats["evictions"].(int64) != 1 || stats["hits"].(int64) != 2 || stats["misses"].(int64) != 1 {
+		t.Errorf("unexpected cache stats: %v", stats)
+	}
+}
+
+func TestFollowerCacheExpires(t *testing.T) {
+	c := newFollowerCache(10, time.Millisecond)
+	c.put("a", []string{"1"})
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := c.get("a"); ok {
+		t.Error("expired key should not be returned")
+	}
+}
+
+func TestFollowerCacheAdd(t *testing.T) {
+	c := newFollowerCache(10, time.Minute)
+	c.add("missing", "1")
+	if _, ok := c.get("missing"); ok {
+		t.Error("add should not cache keys that were not cached before")
+	}
+
+	c.put("a", []string{})
+	cached, _ := c.get("a")
+	c.add("a", "1")
+	c.add("a", "1")
+	if values, _ := c.get("a"); len(values) != 1 || values[0] != "1" {
+		t.Errorf("add should refresh cached followers, got %v", values)
+	}
+	if len(cached) != 0 {
+		t.Error("add should not modify followers returned earlier")
+	}
+}
+
+func TestNilFollowerCache(t *testing.T) {
+	var c *followerCache
+	c.put("a", []string{"1"})
+	c.add("a", "2")
+	if _, ok := c.get("a"); ok {
+		t.Error("disabled cache should never hit")
+	}
+}
+
+func TestRandomFollower(t *testing.T) {
+	if randomFollower(nil) != "" {
+		t.Error("randomFollower should return empty string when there are no followers")
+	}
+	if randomFollower([]string{"1"}) != "1" {
+		t.Error("randomFollower should pick one of followers")
+	}
+}
+
+func TestBackoffWordCached(t *testing.T) {
+	followersOrig, lengthsOrig := followers, config.ChainLengths
+	defer func() { followers, config.ChainLengths = followersOrig, lengthsOrig }()
+	followers = newFollowerCache(10, time.Minute)
+	config.ChainLengths = []int64{2, 1}
+
+	followers.put("the"+separator+"cat", []string{"sleeps"})
+	followers.put("cat", []string{"sleeps", "eats"})
+	// every key is cached, so the connection is not used at all
+	word, err := backoffWord(nil, []string{"the", "cat"})
+	if err != nil || (word != "sleeps" && word != "eats") {
+		t.Errorf("backoffWord should use cached followers, got %q, %v", word, err)
+	}
+	if stats := followers.stats(); stats["hits"] != int64(2) {
+		t.Errorf("backoffWord should hit the cache for every order: %v", stats)
+	}
+}
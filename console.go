@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const consoleChannel = "#console"
+
+// consoleTransport is a local REPL: lines read from input are treated as
+// messages sent to a channel, responses are written to output.
+// Nothing said in the console is added to the corpus.
+type consoleTransport struct {
+	in     io.Reader
+	out    io.Writer
+	user   string
+	outMtx sync.Mutex
+}
+
+func newConsoleTransport(in io.Reader, out io.Writer) *consoleTransport {
+	user := os.Getenv("USER")
+	if user == "" {
+		user = "you"
+	}
+	return &consoleTransport{in: in, out: out, user: user}
+}
+
+func (t *consoleTransport) run(handle func(message)) error {
+	t.printf("-!- %s joined %s, mention it by name to get a response\n", config.BotName, consoleChannel)
+	scanner := bufio.NewScanner(t.in)
+	for scanner.Scan() {
+		text := scanner.Text()
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		handle(message{
+			source:     consoleChannel,
+			nick:       t.user,
+			text:       text,
+			receivedAt: time.Now(),
+		})
+	}
+	return scanner.Err()
+}
+
+func (t *consoleTransport) nick() string {
+	return config.BotName
+}
+
+func (t *consoleTransport) message(target string, text string) {
+	t.printf("<%s> %s\n", config.BotName, text)
+}
+
+func (t *consoleTransport) action(target string, text string) {
+	t.printf(" * %s %s\n", config.BotName, text)
+}
+
+func (t *consoleTransport) close() {}
+
+func (t *consoleTransport) printf(format string, a ...interface{}) {
+	t.outMtx.Lock()
+	defer t.outMtx.Unlock()
+	fmt.Fprintf(t.out, format, a...)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestConsoleTransport(t *testing.T) {
+	var out bytes.Buffer
+	console := newConsoleTransport(strings.NewReader("hello\n\n  \nare you a bot?\n"), &out)
+	console.user = "tester"
+
+	var received []message
+	p := newProcessor(1)
+	err := console.run(func(m message) {
+		received = append(received, m)
+		p.dispatch(console, m)
+	})
+	p.drain()
+	if err != nil {
+		t.Error("consoleTransport.run returned unexpected error: " + err.Error())
+	}
+	if len(received) != 2 {
+		t.Fatalf("consoleTransport should skip empty lines, got %d messages", len(received))
+	}
+	for _, m := range received {
+		if m.source != consoleChannel || m.nick != "tester" || m.private || m.learn {
+			t.Errorf("consoleTransport produced unexpected message: %#v", m)
+		}
+	}
+	if !strings.Contains(out.String(), "<"+config.BotName+"> tester: no :-^-)") {
+		t.Error("consoleTransport should print predefined response, got: " + out.String())
+	}
+
+	out.Reset()
+	console.action(consoleChannel, "purrs")
+	if out.String() != " * "+config.BotName+" purrs\n" {
+		t.Error("consoleTransport should print actions, got: " + out.String())
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// conversation keeps the last messages in every channel (including responses of the bot),
+// so short messages like "lol" or "why?" can be answered in context
+type conversation struct {
+	mtx      sync.Mutex
+	size     int
+	channels map[string][]said
+	replies  map[string]said // the last response of the bot in every channel, nick is the addressee
+}
+
+// said is a message in the conversation
+type said struct {
+	nick string
+	text string
+	at   time.Time
+}
+
+var history = newConversation(0)
+
+func newConversation(size int) *conversation {
+	return &conversation{size: size, channels: make(map[string][]said), replies: make(map[string]said)}
+}
+
+// add appends message to the window of the channel, dropping the oldest one
+func (c *conversation) add(channel string, nick string, text string, at time.Time) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	channel = strings.ToLower(channel)
+	messages := append(c.channels[channel], said{nick: nick, text: text, at: at})
+	if len(messages) > c.size {
+		messages = messages[len(messages)-c.size:]
+	}
+	c.channels[channel] = messages
+}
+
+// replied records the response of the bot to the nick
+func (c *conversation) replied(channel string, botNick string, nick string, text string, at time.Time) {
+	c.add(channel, botNick, text, at)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.replies[strings.ToLower(channel)] = said{nick: nick, text: text, at: at}
+}
+
+// before returns messages in the channel said before the time
+func (c *conversation) before(channel string, at time.Time) []said {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	var messages []said
+	for _, m := range c.channels[strings.ToLower(channel)] {
+		if m.at.Before(at) {
+			messages = append(messages, m)
+		}
+	}
+	return messages
+}
+
+// inThread tells if the message of nick is likely a reply to the last response of the bot,
+// i.e. the bot responded to the nick less than ThreadWindow seconds ago
+func (c *conversation) inThread(channel string, nick string, at time.Time) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	last, ok := c.replies[strings.ToLower(channel)]
+	return ok && strings.EqualFold(last.nick, nick) && at.Sub(last.at) < time.Duration(config.ThreadWindow)*time.Second
+}
+
+// isShort tells if message has too few words to build a response on
+func isShort(words []string) bool {
+	count := 0
+	for _, word := range words {
+		if word != start && word != stop && !isPunctuation(word) {
+			count++
+		}
+	}
+	return count <= int(config.ShortMessageWords)
+}
+
+// withContext adds words and seeds of recent messages in the channel to the short input,
+// context words go before the stop marker, so artificialSeed uses them as well
+func withContext(channel string, at time.Time, words []string, seeds [][]string) ([]string, [][]string) {
+	if !isShort(words) {
+		return words, seeds
+	}
+	var previous []string
+	for _, m := range history.before(channel, at) {
+		contextWords, contextSeeds := processInput(strings.TrimSpace(m.text), false)
+		previous = append(previous, withoutMarkers(contextWords)...)
+		seeds = append(seeds, contextSeeds...)
+	}
+	if len(previous) == 0 {
+		return words, seeds
+	}
+	end := len(words)
+	if end > 0 && words[end-1] == stop {
+		end--
+	}
+	return append(append(append([]string{}, words[:end]...), previous...), words[end:]...), seeds
+}
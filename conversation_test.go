@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConversation(t *testing.T) {
+	c := newConversation(2)
+	now := time.Now()
+	c.add("#Cats", "alice", "one", now.Add(-3*time.Second))
+	c.add("#cats", "bob", "two", now.Add(-2*time.Second))
+	c.add("#cats", "alice", "three", now)
+
+	messages := c.before("#cats", now)
+	if len(messages) != 1 || messages[0].text != "two" {
+		t.Errorf("conversation should keep the last 2 messages and return those said before, got %v", messages)
+	}
+}
+
+func TestConversationThread(t *testing.T) {
+	windowOrig := config.ThreadWindow
+	config.ThreadWindow = 60
+	defer func() { config.ThreadWindow = windowOrig }()
+
+	c := newConversation(5)
+	now := time.Now()
+	if c.inThread("#cats", "alice", now) {
+		t.Error("there is no thread before the bot responds")
+	}
+	c.replied("#cats", "meowkov", "Alice", "meow", now)
+	if !c.inThread("#cats", "alice", now.Add(10*time.Second)) {
+		t.Error("message of the addressee right after the response should be in thread")
+	}
+	if c.inThread("#cats", "bob", now.Add(10*time.Second)) || c.inThread("#dogs", "alice", now.Add(10*time.Second)) {
+		t.Error("messages of other people or in other channels should not be in thread")
+	}
+	if c.inThread("#cats", "alice", now.Add(2*time.Minute)) {
+		t.Error("thread should expire after ThreadWindow")
+	}
+	if messages := c.before("#cats", now.Add(time.Second)); len(messages) != 1 || messages[0].nick != "meowkov" {
+		t.Error("responses of the bot should be a part of conversation")
+	}
+}
+
+func TestWithContext(t *testing.T) {
+	historyOrig := history
+	history = newConversation(5)
+	defer func() { history = historyOrig }()
+
+	now := time.Now()
+	history.add("#cats", "alice", "do you like kubernetes", now.Add(-time.Second))
+	history.add("#dogs", "bob", "woof woof", now.Add(-time.Second))
+
+	words, seeds := processInput("why?", false)
+	contextWords, contextSeeds := withContext("#cats", now, words, seeds)
+	if !contains(contextWords, "kubernetes") || contains(contextWords, "woof") || len(contextSeeds) <= len(seeds) {
+		t.Error("short messages should be extended with context of the channel, got " + dump(contextWords))
+	}
+	if contextWords[0] != start || contextWords[len(contextWords)-1] != stop || len(withoutMarkers(contextWords)) != len(contextWords)-2 {
+		t.Error("context words should go between markers of the input, got " + dump(contextWords))
+	}
+
+	words, seeds = processInput("what do you think about cats", false)
+	if contextWords, _ = withContext("#cats", now, words, seeds); len(contextWords) != len(words) {
+		t.Error("longer messages should not be extended with context")
+	}
+}
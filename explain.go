@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// where seeds of a candidate came from
+const (
+	fromInput           = "input"           // words of the message (and conversation context)
+	fromTransliteration = "transliteration" // ASCII version of other seeds
+	fromArtificialSeed  = "artificialSeed"  // random chains mixed with input words, see Power
+)
+
+// explanation describes how a response was built
+type explanation struct {
+	Message      string            `json:"message"`
+	Channel      string            `json:"channel,omitempty"`
+	Time         time.Time         `json:"time"`
+	Input        []string          `json:"input"`
+	Response     string            `json:"response"`
+	Selected     string            `json:"selected,omitempty"`
+	Walk         *walkTrace        `json:"walk,omitempty"`         // how the selected candidate was generated
+	MedianCutoff int               `json:"medianCutoff,omitempty"` // candidates shorter than this (in bytes) were discarded
+	Discarded    []string          `json:"discarded,omitempty"`    // by the median cutoff
+	Candidates   []scoredCandidate `json:"candidates"`
+
+	walks map[string]walkTrace // of every candidate, until one is selected
+}
+
+// walkTrace describes how a candidate was generated
+type walkTrace struct {
+	Seed    []string       `json:"seed"`
+	Origin  string         `json:"origin"`          // fromInput, fromTransliteration or fromArtificialSeed
+	Power   int            `json:"power,omitempty"` // of artificialSeed
+	Walk    []string       `json:"walk"`            // words before filters
+	Filters []string       `json:"filters,omitempty"`
+	Keys    []traversedKey `json:"keys,omitempty"`
+}
+
+// traversedKey is a chain followed by the next word of the walk
+type traversedKey struct {
+	Key       string `json:"key"`
+	Next      string `json:"next"`
+	Followers int64  `json:"followers"` // current number of followers of the chain
+}
+
+// walk records how the candidate was generated, the first walk wins (no-op on nil trace)
+func (e *explanation) walk(candidate string, w walkTrace) {
+	if e == nil {
+		return
+	}
+	if e.walks == nil {
+		e.walks = make(map[string]walkTrace)
+	}
+	if _, ok := e.walks[candidate]; !ok {
+		e.walks[candidate] = w
+	}
+}
+
+// medianCutoff records candidates discarded by normalizeResponseChains (no-op on nil trace)
+func (e *explanation) medianCutoff(texts uniqueTexts, kept []string) {
+	if e == nil || len(texts) == 0 {
+		return
+	}
+	e.MedianCutoff = medianLength(texts)
+	e.Discarded = nil
+	for text := range texts {
+		if !contains(kept, text) {
+			e.Discarded = append(e.Discarded, text)
+		}
+	}
+}
+
+// candidates records scored candidates and the selected one (no-op on nil trace)
+func (e *explanation) candidates(candidates []scoredCandidate, selected scoredCandidate) {
+	if e == nil {
+		return
+	}
+	e.Candidates = candidates
+	e.Selected = selected.Text
+	if w, ok := e.walks[selected.Text]; ok {
+		e.Walk = &w
+	}
+	e.walks = nil
+}
+
+// explained returns a copy of the explanation with chains traversed by the selected walk
+// and markers replaced by readable names
+func (e *explanation) explained() *explanation {
+	explained := *e
+	if e.Walk != nil {
+		w := *e.Walk
+		w.Keys = traversedKeys(w.Walk)
+		w.Seed = displayWords(w.Seed)
+		w.Walk = displayWords(w.Walk)
+		explained.Walk = &w
+	}
+	explained.Input = displayWords(e.Input)
+	return &explained
+}
+
+// traversedKeys returns chains followed by every word of the walk (after the seed chain)
+// with their current number of followers, backing off like the walk did
+// when there are several ChainLengths
+func traversedKeys(walk []string) []traversedKey {
+	var steps [][]string // chains of every order before every word
+	for i := int(config.ChainLength); i < len(walk); i++ {
+		var keys []string
+		for _, order := range config.ChainLengths {
+			if int(order) <= i {
+				keys = append(keys, strings.Join(walk[i-int(order):i], separator))
+			}
+		}
+		steps = append(steps, keys)
+	}
+	if len(steps) == 0 {
+		return nil
+	}
+
+	corpus := pool.Get()
+	defer corpus.Close()
+	for _, keys := range steps {
+		for _, key := range keys {
+			corpus.Send("SCARD", key)
+		}
+	}
+	if err := corpus.Flush(); err != nil {
+		redisErr(err)
+		return nil
+	}
+
+	traversed := make([]traversedKey, 0, len(steps))
+	for i, keys := range steps {
+		counts := make([]int64, len(keys))
+		for j := range keys {
+			count, err := redis.Int64(corpus.Receive())
+			if err != nil {
+				redisErr(err)
+				return traversed
+			}
+			counts[j] = count
+		}
+		key := backoff(counts, keys, config.MinFollowers)
+		t := traversedKey{Key: displayKey(key), Next: displayWord(walk[int(config.ChainLength)+i])}
+		for j := range keys {
+			if keys[j] == key {
+				t.Followers = counts[j]
+			}
+		}
+		traversed = append(traversed, t)
+	}
+	return traversed
+}
+
+func displayWord(word string) string {
+	switch word {
+	case start:
+		return "<start>"
+	case stop:
+		return "<stop>"
+	}
+	return word
+}
+
+func displayWords(words []string) []string {
+	displayed := make([]string, len(words))
+	for i, word := range words {
+		displayed[i] = displayWord(word)
+	}
+	return displayed
+}
+
+func displayKey(key string) string {
+	if key == "" {
+		return ""
+	}
+	return strings.Join(displayWords(strings.Split(key, separator)), " ")
+}
+
+// lastExplanations remembers how the last response in every channel was built
+type lastExplanations struct {
+	mtx      sync.Mutex
+	channels map[string]*explanation
+}
+
+var explanations = &lastExplanations{channels: make(map[string]*explanation)}
+
+func (l *lastExplanations) remember(e *explanation) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.channels[strings.ToLower(e.Channel)] = e
+}
+
+func (l *lastExplanations) last(channel string) *explanation {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.channels[strings.ToLower(channel)]
+}
+
+// explain generates a fresh response to the message, without learning it
+func explain(ctx context.Context, message string) *explanation {
+	trace := &explanation{Message: message, Channel: settingsFrom(ctx).Channel, Time: time.Now()}
+	words, seeds := processInput(strings.TrimSpace(message), false)
+	trace.Input = words
+	trace.Response = explainResponse(ctx, words, seeds, int(config.MaxResponseTries), trace)
+	return trace
+}
+
+// explainHandler serves /explain?message=…[&channel=…] with JSON explanation of a fresh response
+// (generated with settings of the channel, overridden by parameters like temperature=1.5),
+// or /explain?last=1&channel=… with explanation of the last response in the channel
+func explainHandler(w http.ResponseWriter, r *http.Request) {
+	var trace *explanation
+	if r.FormValue("last") != "" {
+		if trace = explanations.last(r.FormValue("channel")); trace == nil {
+			http.Error(w, "no response in the channel yet", http.StatusNotFound)
+			return
+		}
+	} else {
+		message := r.FormValue("message")
+		if strings.TrimSpace(message) == "" {
+			http.Error(w, "missing 'message' (or 'last') parameter", http.StatusBadRequest)
+			return
+		}
+		override, err := parseSettings(r.Form)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s := settingsFor(r.FormValue("channel"))
+		s.apply(override)
+		ctx := withSettings(r.Context(), s)
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(config.GenerationTimeout)*time.Millisecond)
+		defer cancel()
+		trace = explain(ctx, message)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(trace.explained())
+}
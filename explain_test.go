@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPostprocessFilters(t *testing.T) {
+	blacklistOrig, dontEndWithOrig := config.Blacklist, config.DontEndWith
+	defer func() { config.Blacklist, config.DontEndWith = blacklistOrig, dontEndWithOrig }()
+	config.Blacklist = []string{"damn"}
+	config.DontEndWith = []string{"the"}
+
+	test := func(words []string, expected []string, filters []string) {
+		output, applied := postprocessFilters(words)
+		if !reflect.DeepEqual(output, expected) || !reflect.DeepEqual(applied, filters) {
+			t.Errorf("postprocessFilters(%v) returned %v %v instead of %v %v", words, output, applied, expected, filters)
+		}
+	}
+	test([]string{start, "a", "cat"}, []string{"a", "cat"}, nil)
+	test([]string{start, "a", "damn", "cat"}, []string{"a", "cat"}, []string{"Blacklist"})
+	test([]string{"a", "cat", "ate", "the"}, []string{"a", "cat", "ate"}, []string{"DontEndWith"})
+	test([]string{"(", "a", "damn", "cat", ","}, []string{"(", "a", "cat", ")"}, []string{"Blacklist", "DontEndWith", "UnbalancedPunctuation"})
+}
+
+func TestExplanationTrace(t *testing.T) {
+	var none *explanation
+	none.walk("a cat", walkTrace{})
+	none.medianCutoff(uniqueTexts{"a cat": {}}, nil)
+	none.candidates(nil, scoredCandidate{})
+
+	trace := &explanation{}
+	trace.walk("a cat", walkTrace{Origin: fromInput})
+	trace.walk("a cat", walkTrace{Origin: fromTransliteration})
+	trace.walk("a dog", walkTrace{Origin: fromArtificialSeed, Power: 8})
+
+	texts := uniqueTexts{"a cat": {}, "a dog": {}, "a lazy dog": {}, "a very lazy dog": {}}
+	kept := normalizeResponseChains(texts)
+	trace.medianCutoff(texts, kept)
+	if trace.MedianCutoff != 10 || len(trace.Discarded) != 2 {
+		t.Errorf("medianCutoff should record discarded candidates: %d %v", trace.MedianCutoff, trace.Discarded)
+	}
+
+	trace.candidates([]scoredCandidate{{Text: "a dog"}}, scoredCandidate{Text: "a dog"})
+	if trace.Walk == nil || trace.Walk.Origin != fromArtificialSeed || trace.Walk.Power != 8 || trace.walks != nil {
+		t.Errorf("candidates should keep the walk of the selected candidate: %+v", trace.Walk)
+	}
+}
+
+func TestDisplayKey(t *testing.T) {
+	if key := displayKey(start + separator + "hello"); key != "<start> hello" {
+		t.Error("displayKey returned " + key)
+	}
+	if words := displayWords([]string{"bye", stop}); !reflect.DeepEqual(words, []string{"bye", "<stop>"}) {
+		t.Error("displayWords returned " + dump(words))
+	}
+}
+
+func TestExplainHandlerLast(t *testing.T) {
+	w := httptest.NewRecorder()
+	explainHandler(w, httptest.NewRequest("GET", "/explain?last=1&channel=%23nowhere", nil))
+	if w.Code != http.StatusNotFound {
+		t.Error("explain of the last response in a quiet channel should not be found, got ", w.Code)
+	}
+
+	explanations.remember(&explanation{Channel: "#Cats", Message: "meow", Response: "purr"})
+	w = httptest.NewRecorder()
+	explainHandler(w, httptest.NewRequest("GET", "/explain?last=1&channel=%23cats", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"response": "purr"`) {
+		t.Error("explain should return the last response in the channel, got ", w.Code, w.Body.String())
+	}
+}
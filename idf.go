@@ -0,0 +1,130 @@
+package main
+
+import (
+	"math"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// hash with the number of learned lines containing each word,
+// field start holds the number of all learned lines (can't collide with chains)
+const wordsKey = start + "words"
+
+// wordStats are corpus statistics of words used to find salient (rare) words
+type wordStats struct {
+	lines  int
+	counts map[string]int
+}
+
+// seedWords returns distinct words of a learned line (skipping markers, punctuation and openings)
+func seedWords(seeds [][]string) []string {
+	var words []string
+	for _, seed := range seeds {
+		for _, word := range seed {
+			if word == start || word == stop || word == openingsKey || strings.Contains(word, separator) ||
+				isPunctuation(word) || contains(words, word) {
+				continue
+			}
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+// fetchWordStats asks for the number of lines containing words, in one round-trip
+func fetchWordStats(words []string) wordStats {
+	stats := wordStats{counts: make(map[string]int)}
+	if len(words) == 0 {
+		return stats
+	}
+	corpus := pool.Get()
+	defer corpus.Close()
+	args := redis.Args{}.Add(wordsKey, start)
+	for _, word := range words {
+		args = args.Add(word)
+	}
+	values, err := redis.Values(corpus.Do("HMGET", args...))
+	if err != nil {
+		redisErr(err)
+		return stats
+	}
+	counts := make([]int, len(values))
+	for i, value := range values {
+		counts[i], _ = redis.Int(value, nil) // missing fields are nil
+	}
+	stats.lines = counts[0]
+	for i, word := range words {
+		stats.counts[word] = counts[i+1]
+	}
+	return stats
+}
+
+// idf (inverse document frequency) is high for rare words and close to zero for common ones
+func (w wordStats) idf(word string) float64 {
+	return math.Log(float64(w.lines+1) / float64(w.counts[word]+1))
+}
+
+// isStopword tells if the word is too common (or not a word at all) to be worth building a response on,
+// StopwordFrequency 0 means only markers and punctuation are
+func (w wordStats) isStopword(word string) bool {
+	return word == start || word == stop || isPunctuation(word) ||
+		(config.StopwordFrequency > 0 && float64(w.counts[word]) > config.StopwordFrequency*float64(w.lines))
+}
+
+// seedWeights is the mean idf of words in the key of every seed, zero for seeds made of stopwords only
+func seedWeights(seeds [][]string, stats wordStats) []float64 {
+	weights := make([]float64, len(seeds))
+	for i, seed := range seeds {
+		var sum float64
+		var words int
+		for _, word := range seed[:config.ChainLength] {
+			if !stats.isStopword(word) {
+				sum += stats.idf(word)
+				words++
+			}
+		}
+		if words > 0 {
+			weights[i] = sum / float64(words)
+		}
+	}
+	return weights
+}
+
+// walkBudget distributes ChainsToTry walks per seed between seeds proportionally to their weights,
+// seeds of zero weight get no walks (unless all of them are zero, then walks are split evenly)
+func walkBudget(weights []float64) []int {
+	budget := make([]int, len(weights))
+	var total float64
+	for _, weight := range weights {
+		total += weight
+	}
+	walks := float64(config.ChainsToTry) * float64(len(weights))
+	for i, weight := range weights {
+		switch {
+		case total == 0:
+			budget[i] = int(config.ChainsToTry)
+		case weight > 0:
+			budget[i] = int(math.Max(1, math.Floor(walks*weight/total)))
+		}
+	}
+	return budget
+}
+
+// seedBudget returns the number of walks for every seed, weighted by rarity of seed words
+func seedBudget(seeds [][]string) []int {
+	var words []string
+	for _, seed := range seeds {
+		for _, word := range seed[:config.ChainLength] {
+			if !contains(words, word) {
+				words = append(words, word)
+			}
+		}
+	}
+	stats := fetchWordStats(words)
+	if stats.lines == 0 {
+		// corpus without statistics (or Redis error)
+		return walkBudget(make([]float64, len(seeds)))
+	}
+	return walkBudget(seedWeights(seeds, stats))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSeedWords(t *testing.T) {
+	words := parseInput("what? what do you think about kubernetes")
+	lessons := append(learnedSeeds(words, createSeeds(words)), openingSeed(words))
+	expected := []string{"what", "do", "you", "think", "about", "kubernetes"}
+	if output := seedWords(lessons); !reflect.DeepEqual(output, expected) {
+		t.Error("seedWords returned " + dump(output) + " instead of " + dump(expected))
+	}
+}
+
+func TestSeedWeights(t *testing.T) {
+	stats := wordStats{lines: 100, counts: map[string]int{"what": 30, "do": 40, "you": 50, "think": 3, "kubernetes": 0}}
+	if !stats.isStopword("what") || !stats.isStopword("?") || stats.isStopword("think") {
+		t.Error("isStopword should detect words present in too many lines")
+	}
+	if stats.idf("kubernetes") <= stats.idf("think") || stats.idf("think") <= stats.idf("what") {
+		t.Error("idf should be higher for rare words")
+	}
+
+	seeds := createSeeds(parseInput("what do you think about kubernetes"))
+	weights := seedWeights(seeds, stats)
+	if weights[0] != 0 || weights[1] != 0 || weights[2] != 0 {
+		t.Errorf("seeds made of stopwords should have zero weight: %v", weights)
+	}
+	if weights[3] <= 0 || weights[5] <= weights[3] {
+		t.Errorf("seeds with rare words should have higher weight: %v", weights)
+	}
+
+	frequencyOrig := config.StopwordFrequency
+	defer func() { config.StopwordFrequency = frequencyOrig }()
+	config.StopwordFrequency = 0
+	if stats.isStopword("what") || !stats.isStopword("?") {
+		t.Error("isStopword should detect only punctuation and markers when StopwordFrequency is 0")
+	}
+}
+
+func TestWalkBudget(t *testing.T) {
+	chainsOrig := config.ChainsToTry
+	config.ChainsToTry = 10
+	defer func() { config.ChainsToTry = chainsOrig }()
+
+	if budget := walkBudget([]float64{0, 0}); !reflect.DeepEqual(budget, []int{10, 10}) {
+		t.Errorf("walks should be split evenly without weights, got %v", budget)
+	}
+	if budget := walkBudget([]float64{0, 1, 3}); !reflect.DeepEqual(budget, []int{0, 7, 22}) {
+		t.Errorf("walks should be split proportionally to weights, got %v", budget)
+	}
+	if budget := walkBudget([]float64{0.001, 1000}); budget[0] != 1 {
+		t.Errorf("every seed with positive weight should get at least one walk, got %v", budget)
+	}
+}
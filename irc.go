@@ -0,0 +1,508 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/thoj/go-ircevent"
+)
+
+// NickServ notices confirming successful identification
+var nickServIdentified = regexp.MustCompile(`(?i)(you are now (identified|logged in)|password accepted)`)
+
+// server messages sent when connection is refused due to a ban (K-line, G-line, ...)
+var ircBanned = regexp.MustCompile(`(?i)(k-lined|g-lined|banned)`)
+
+// ircTransport is a transport backed by go-ircevent.
+// Every (re)connection uses a fresh irc.Connection, state worth restoring
+// (primary nick, authentication, joined channels) lives here.
+type ircTransport struct {
+	mtx           sync.Mutex
+	con           *irc.Connection
+	queue         *sendQueue      // outgoing messages of the current connection
+	channels      map[string]bool // channels to (re)join
+	joined        map[string]bool // channels joined during the current connection
+	identified    chan struct{}   // closed when NickServ confirms identity
+	authenticated bool
+	registered    bool          // true after 001, nick collisions are handled differently before
+	banned        bool          // true if server refused connection due to a ban
+	triedNicks    int           // number of alternate nicks tried during registration
+	regainStop    chan struct{} // stops periodic attempts to regain primary nick
+	done          chan struct{}
+}
+
+func newIrcTransport() *ircTransport {
+	t := &ircTransport{
+		channels: make(map[string]bool),
+		joined:   make(map[string]bool),
+		done:     make(chan struct{}),
+	}
+	for _, channel := range config.Channels {
+		t.channels[strings.ToLower(channel)] = true
+	}
+	return t
+}
+
+// run is a supervisor which reconnects with exponential backoff after any disconnect
+func (t *ircTransport) run(handle func(message)) error {
+	failures := 0
+	for {
+		registered, err := t.session(handle)
+		if t.closing() {
+			return nil
+		}
+		if registered {
+			failures = 0
+		}
+		failures++
+		if config.IrcMaxReconnects > 0 && failures > int(config.IrcMaxReconnects) {
+			return errors.New("unable to reconnect to IRC after " + fmt.Sprint(failures-1) + " attempts: " + fmt.Sprint(err))
+		}
+
+		delay := reconnectDelay(failures)
+		t.mtx.Lock()
+		if t.banned {
+			delay = time.Duration(config.IrcMaxReconnectDelay) * time.Second
+		}
+		t.mtx.Unlock()
+		log.Warn("Disconnected from IRC (", err, "), reconnecting in ", delay)
+
+		select {
+		case <-t.done:
+			return nil
+		case <-time.After(delay):
+		}
+	}
+}
+
+// session connects to IRC and blocks until the connection is lost,
+// returns true if registration was completed before that
+func (t *ircTransport) session(handle func(message)) (bool, error) {
+	defer t.resetSession()
+	useSASL := config.IrcSASLMechanism != ""
+
+	log.Println("Connecting to IRC at " + config.IrcServer)
+	con := t.newConnection(handle, useSASL)
+	err := con.Connect(config.IrcServer)
+	if err != nil && useSASL && nickServPassword() != "" {
+		log.Warn("SASL authentication failed (", err, "), falling back to NickServ")
+		if con.ErrorChan() != nil {
+			// connected before SASL failed, close the socket and stop its loops
+			con.Disconnect()
+		}
+		con = t.newConnection(handle, false)
+		err = con.Connect(config.IrcServer)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	err = <-con.ErrorChan()
+	con.Disconnect()
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.registered, err
+}
+
+// newConnection prepares irc.Connection with all callbacks
+func (t *ircTransport) newConnection(handle func(message), useSASL bool) *irc.Connection {
+	con := irc.IRC(config.BotName, config.BotName)
+	con.UseTLS = config.UseTLS
+	con.Debug = config.Debug
+	con.Version = "meowkov @ " + version + " (https://github.com/lidel/meowkov)"
+	if config.QuitMessage != "" {
+		con.QuitMessage = config.QuitMessage
+	}
+	if config.IrcPassword != "" {
+		con.Password = config.IrcPassword
+	}
+	setupAuth(con, useSASL)
+
+	queue := newSendQueue(func(m outgoing) {
+		if m.action {
+			con.Action(m.target, m.text)
+		} else {
+			con.Privmsg(m.target, m.text)
+		}
+	}, t.inChannel)
+
+	t.mtx.Lock()
+	if t.queue != nil {
+		t.queue.stop()
+	}
+	t.con = con
+	t.queue = queue
+	t.banned = false
+	t.mtx.Unlock()
+
+	// replace default handlers which just append "_" to taken nick
+	con.ClearCallback("433")
+	con.ClearCallback("437")
+	con.AddCallback("433", t.nickInUse) // ERR_NICKNAMEINUSE
+	con.AddCallback("437", t.nickInUse) // ERR_UNAVAILRESOURCE
+
+	con.AddCallback("001", func(e *irc.Event) {
+		t.mtx.Lock()
+		t.registered = true
+		t.authenticated = con.UseSASL
+		t.mtx.Unlock()
+		t.startNickRegain()
+
+		if con.UseSASL || nickServPassword() == "" {
+			t.joinChannels()
+			return
+		}
+		identified := t.identify()
+		go func() {
+			// delay joins until services confirm our identity
+			select {
+			case <-identified:
+				log.Println("Identified to NickServ")
+			case <-time.After(time.Duration(config.IrcAuthTimeout) * time.Second):
+				log.Warn("NickServ did not confirm identification in time, joining channels anyway")
+			}
+			t.joinChannels()
+		}()
+	})
+
+	con.AddCallback("900", func(e *irc.Event) { // RPL_LOGGEDIN
+		t.confirmIdentity()
+	})
+
+	con.AddCallback("NOTICE", func(e *irc.Event) {
+		if strings.EqualFold(e.Nick, "NickServ") && nickServIdentified.MatchString(e.Message()) {
+			t.confirmIdentity()
+		}
+	})
+
+	banned := func(e *irc.Event) {
+		if e.Code == "465" || ircBanned.MatchString(e.Message()) {
+			log.Error("Banned from IRC server: " + e.Message())
+			t.mtx.Lock()
+			t.banned = true
+			t.mtx.Unlock()
+		}
+	}
+	con.AddCallback("465", banned) // ERR_YOUREBANNEDCREEP
+	con.AddCallback("ERROR", banned)
+
+	con.AddCallback("JOIN", func(e *irc.Event) {
+		if strings.EqualFold(e.Nick, con.GetNick()) {
+			t.trackChannel(e.Message(), true)
+		}
+		if react(config.DefaultChattiness) {
+			room, _ := inputSource(e.Raw, con.GetNick())
+			t.message(room, randomSmiley())
+			bumpLastReaction()
+		}
+	})
+
+	con.AddCallback("PART", func(e *irc.Event) {
+		if strings.EqualFold(e.Nick, con.GetNick()) && len(e.Arguments) > 0 {
+			t.trackChannel(e.Arguments[0], false)
+		}
+	})
+
+	con.AddCallback("KICK", func(e *irc.Event) {
+		if len(e.Arguments) > 1 && strings.EqualFold(e.Arguments[1], con.GetNick()) {
+			log.Warn("Kicked from " + e.Arguments[0] + " by " + e.Nick + ": " + e.Message())
+			t.trackChannel(e.Arguments[0], false)
+		}
+	})
+
+	con.AddCallback("PRIVMSG", func(e *irc.Event) {
+		source, privateQuery := inputSource(e.Raw, con.GetNick())
+		handle(message{
+			source:     source,
+			nick:       e.Nick,
+			text:       e.Message(),
+			private:    privateQuery,
+			learn:      !privateQuery,
+			receivedAt: time.Now(),
+		})
+	})
+
+	return con
+}
+
+// setupAuth configures SASL (PLAIN or EXTERNAL with a client certificate)
+func setupAuth(con *irc.Connection, useSASL bool) {
+	if config.IrcClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(config.IrcClientCert, config.IrcClientKey)
+		check(err, "Unable to load IRC client certificate: ")
+		con.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	if !useSASL {
+		return
+	}
+	switch mechanism := strings.ToUpper(config.IrcSASLMechanism); mechanism {
+	case "PLAIN", "EXTERNAL":
+		con.UseSASL = true
+		con.SASLMech = mechanism
+		con.SASLLogin = saslLogin()
+		con.SASLPassword = config.IrcSASLPassword
+	default:
+		log.Panicln("Unsupported IrcSASLMechanism: " + mechanism)
+	}
+}
+
+// identify sends IDENTIFY to NickServ, returns channel closed on success
+func (t *ircTransport) identify() chan struct{} {
+	t.mtx.Lock()
+	t.identified = make(chan struct{})
+	identified := t.identified
+	t.mtx.Unlock()
+
+	log.Println("Identifying to NickServ as " + saslLogin())
+	t.connection().Privmsg("NickServ", "IDENTIFY "+saslLogin()+" "+nickServPassword())
+	return identified
+}
+
+func (t *ircTransport) confirmIdentity() {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.authenticated = true
+	if t.identified != nil {
+		close(t.identified)
+		t.identified = nil
+	}
+}
+
+// nickInUse picks the next alternate nick during registration,
+// failed attempts to regain primary nick are ignored
+func (t *ircTransport) nickInUse(e *irc.Event) {
+	t.mtx.Lock()
+	if t.registered {
+		t.mtx.Unlock()
+		if config.Debug {
+			log.Println("Primary nick " + config.BotName + " is still in use")
+		}
+		return
+	}
+	next := alternateNick(t.triedNicks)
+	t.triedNicks++
+	t.mtx.Unlock()
+
+	log.Warn("Nick ", e.Arguments[1:], " is not available, trying "+next)
+	t.connection().Nick(next)
+}
+
+// startNickRegain periodically tries to get primary nick back
+func (t *ircTransport) startNickRegain() {
+	stop := make(chan struct{})
+	t.mtx.Lock()
+	if t.regainStop != nil {
+		close(t.regainStop)
+	}
+	t.regainStop = stop
+	t.mtx.Unlock()
+
+	if config.NickRegainInterval < 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(config.NickRegainInterval) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				t.regainNick()
+			}
+		}
+	}()
+}
+
+func (t *ircTransport) regainNick() {
+	if strings.EqualFold(t.nick(), config.BotName) {
+		return
+	}
+	t.mtx.Lock()
+	authenticated := t.authenticated
+	t.mtx.Unlock()
+
+	log.Println("Trying to regain primary nick " + config.BotName)
+	con := t.connection()
+	if authenticated {
+		// services disconnect (GHOST) or rename (REGAIN) whoever is using our nick
+		con.Privmsg("NickServ", config.NickRegainCommand+" "+config.BotName)
+	}
+	con.Nick(config.BotName)
+}
+
+// resetSession forgets state of the previous connection
+func (t *ircTransport) resetSession() {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.registered = false
+	t.authenticated = false
+	t.triedNicks = 0
+	t.joined = make(map[string]bool)
+	if t.queue != nil {
+		t.queue.stop()
+		t.queue = nil
+	}
+	if t.regainStop != nil {
+		close(t.regainStop)
+		t.regainStop = nil
+	}
+}
+
+// joinChannels (re)joins configured channels and channels joined later
+func (t *ircTransport) joinChannels() {
+	t.mtx.Lock()
+	channels := make([]string, 0, len(t.channels))
+	for channel := range t.channels {
+		channels = append(channels, channel)
+	}
+	t.mtx.Unlock()
+
+	sort.Strings(channels)
+	con := t.connection()
+	for _, channel := range channels {
+		con.Join(channel)
+	}
+}
+
+func (t *ircTransport) trackChannel(channel string, joined bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	channel = strings.ToLower(channel)
+	if joined {
+		t.channels[channel] = true
+		t.joined[channel] = true
+	} else {
+		delete(t.channels, channel)
+		delete(t.joined, channel)
+		if t.queue != nil {
+			t.queue.drop(channel)
+		}
+	}
+}
+
+// inChannel returns false for channels the bot is not in (anymore),
+// private messages are always allowed
+func (t *ircTransport) inChannel(target string) bool {
+	if !isChannel(target) {
+		return true
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.joined[strings.ToLower(target)]
+}
+
+func (t *ircTransport) connection() *irc.Connection {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.con
+}
+
+func (t *ircTransport) closing() bool {
+	select {
+	case <-t.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *ircTransport) nick() string {
+	if con := t.connection(); con != nil {
+		return con.GetNick()
+	}
+	return config.BotName
+}
+
+func (t *ircTransport) message(target string, text string) {
+	t.send(target, text, false)
+}
+
+func (t *ircTransport) action(target string, text string) {
+	t.send(target, text, true)
+}
+
+func (t *ircTransport) send(target string, text string, action bool) {
+	t.mtx.Lock()
+	con, queue := t.con, t.queue
+	t.mtx.Unlock()
+	if con != nil && queue != nil && con.Connected() {
+		queue.push(target, text, action, con.GetNick())
+	}
+}
+
+func (t *ircTransport) close() {
+	if t.closing() {
+		return
+	}
+	close(t.done)
+	if con := t.connection(); con != nil && con.Connected() {
+		log.Warn("Disconnecting from IRC")
+		con.Quit()
+		con.Disconnect()
+	}
+}
+
+func isChannel(target string) bool {
+	return target != "" && strings.ContainsAny(target[:1], "#&+!")
+}
+
+// reconnectDelay returns exponential backoff with jitter for n-th consecutive failure
+func reconnectDelay(failures int) time.Duration {
+	delay := time.Duration(config.IrcReconnectDelay) * time.Second
+	max := time.Duration(config.IrcMaxReconnectDelay) * time.Second
+	for i := 1; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	// jitter: random value between 50% and 100% of the delay
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// alternateNick returns nick to try after n failed attempts:
+// AlternateNicks first, then BotName with growing number of underscores
+func alternateNick(n int) string {
+	if n < len(config.AlternateNicks) {
+		return config.AlternateNicks[n]
+	}
+	return config.BotName + strings.Repeat("_", n-len(config.AlternateNicks)+1)
+}
+
+// account name used for SASL and NickServ
+func saslLogin() string {
+	if config.IrcSASLLogin != "" {
+		return config.IrcSASLLogin
+	}
+	return config.BotName
+}
+
+// password used for NickServ fallback
+func nickServPassword() string {
+	if config.NickServPassword != "" {
+		return config.NickServPassword
+	}
+	if strings.ToUpper(config.IrcSASLMechanism) == "PLAIN" {
+		return config.IrcSASLPassword
+	}
+	return ""
+}
+
+func inputSource(raw string, ownNick string) (string, bool) {
+	channel := strings.Split(raw, " ")[2]
+	privateQuery := channel == ownNick
+	if privateQuery {
+		channel = strings.Split(raw[1:], "!")[0]
+	}
+	return channel, privateQuery
+}
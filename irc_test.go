@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNickServIdentified(t *testing.T) {
+	test := func(notice string, expected bool) {
+		if nickServIdentified.MatchString(notice) != expected {
+			t.Errorf("nickServIdentified should return %v for %q", expected, notice)
+		}
+	}
+	test("You are now identified for meowkov.", true)
+	test("You are now logged in as meowkov.", true)
+	test("Password accepted - you are now recognized.", true)
+	test("Invalid password for meowkov.", false)
+	test("This nickname is registered. Please choose a different nickname.", false)
+}
+
+func TestNickServPassword(t *testing.T) {
+	orig := config
+	defer func() { config = orig }()
+
+	config.IrcSASLMechanism = "plain"
+	config.IrcSASLPassword = "sasl"
+	if nickServPassword() != "sasl" {
+		t.Error("nickServPassword should fall back to SASL PLAIN password")
+	}
+	config.NickServPassword = "nickserv"
+	if nickServPassword() != "nickserv" {
+		t.Error("nickServPassword should prefer NickServPassword")
+	}
+	config.NickServPassword = ""
+	config.IrcSASLMechanism = "EXTERNAL"
+	if nickServPassword() != "" {
+		t.Error("nickServPassword should be empty for SASL EXTERNAL")
+	}
+
+	config.IrcSASLLogin = ""
+	if saslLogin() != config.BotName {
+		t.Error("saslLogin should default to BotName")
+	}
+}
+
+func TestAlternateNick(t *testing.T) {
+	orig := config.AlternateNicks
+	defer func() { config.AlternateNicks = orig }()
+
+	config.AlternateNicks = []string{"meow", "kov"}
+	expected := []string{"meow", "kov", config.BotName + "_", config.BotName + "__"}
+	for i, nick := range expected {
+		if alternateNick(i) != nick {
+			t.Errorf("alternateNick(%d) should return %s but got %s", i, nick, alternateNick(i))
+		}
+	}
+}
+
+func TestReconnectDelay(t *testing.T) {
+	delayOrig, maxOrig := config.IrcReconnectDelay, config.IrcMaxReconnectDelay
+	config.IrcReconnectDelay, config.IrcMaxReconnectDelay = 5, 60
+	defer func() { config.IrcReconnectDelay, config.IrcMaxReconnectDelay = delayOrig, maxOrig }()
+
+	test := func(failures int, expected time.Duration) {
+		for i := 0; i < 100; i++ {
+			delay := reconnectDelay(failures)
+			if delay < expected/2 || delay > expected {
+				t.Errorf("reconnectDelay(%d) should be between %v and %v but got %v", failures, expected/2, expected, delay)
+				return
+			}
+		}
+	}
+	test(1, 5*time.Second)
+	test(2, 10*time.Second)
+	test(3, 20*time.Second)
+	test(4, 40*time.Second)
+	test(5, 60*time.Second)
+	test(100, 60*time.Second)
+}
+
+func TestIrcBanned(t *testing.T) {
+	if !ircBanned.MatchString("Closing Link: meowkov[1.2.3.4] (K-Lined)") {
+		t.Error("ircBanned should detect K-line")
+	}
+	if ircBanned.MatchString("Closing Link: meowkov[1.2.3.4] (Ping timeout: 240 seconds)") {
+		t.Error("ircBanned should ignore ping timeouts")
+	}
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const matrixAPI = "/_matrix/client/r0"
+
+// matrixTransport is a transport talking to a Matrix homeserver
+// via the client-server API
+type matrixTransport struct {
+	homeserver    string
+	client        *http.Client
+	syncTimeout   time.Duration
+	retryDelay    time.Duration // doubled after every failure in a row, up to maxRetryDelay
+	maxRetryDelay time.Duration
+
+	accessToken string
+	userID      string
+	displayName string
+
+	mtx     sync.Mutex
+	members map[string]map[string]string // room → user → display name
+	direct  map[string][]string          // user → direct chats with the user (m.direct account data)
+	txn     int64
+	done    chan struct{}
+}
+
+type matrixEvent struct {
+	Type     string          `json:"type"`
+	Sender   string          `json:"sender"`
+	StateKey *string         `json:"state_key"`
+	Content  json.RawMessage `json:"content"`
+}
+
+type matrixEvents struct {
+	Events []matrixEvent `json:"events"`
+}
+
+type matrixSync struct {
+	NextBatch   string       `json:"next_batch"`
+	AccountData matrixEvents `json:"account_data"`
+	Rooms       struct {
+		Join map[string]struct {
+			State    matrixEvents `json:"state"`
+			Timeline matrixEvents `json:"timeline"`
+		} `json:"join"`
+		Invite map[string]struct {
+			InviteState matrixEvents `json:"invite_state"`
+		} `json:"invite"`
+	} `json:"rooms"`
+}
+
+func newMatrixTransport(homeserver string) *matrixTransport {
+	return &matrixTransport{
+		homeserver:    strings.TrimRight(homeserver, "/"),
+		client:        &http.Client{Timeout: 90 * time.Second},
+		syncTimeout:   30 * time.Second,
+		retryDelay:    5 * time.Second,
+		maxRetryDelay: 10 * time.Minute,
+		accessToken:   config.MatrixAccessToken,
+		members:       make(map[string]map[string]string),
+		direct:        make(map[string][]string),
+		done:          make(chan struct{}),
+	}
+}
+
+// run retries failed logins and syncs with backoff, so an unreachable homeserver
+// does not stop other transports; it returns only when the transport is closed
+func (t *matrixTransport) run(handle func(message)) error {
+	log.Println("Connecting to Matrix at " + t.homeserver)
+	for failures := 1; ; failures++ {
+		err := t.login()
+		if err == nil {
+			break
+		}
+		log.Error("Matrix login failed: ", err)
+		if !t.backoff(failures) {
+			return nil
+		}
+	}
+	for _, room := range config.MatrixRooms {
+		if err := t.join(room); err != nil {
+			log.Error("Unable to join Matrix room "+room+": ", err)
+		}
+	}
+
+	// initial sync only establishes the starting point, old messages are ignored
+	since := ""
+	for failures := 1; ; failures++ {
+		batch, err := t.sync(since, 0)
+		if err == nil {
+			t.processSync(batch, nil)
+			since = batch.NextBatch
+			break
+		}
+		log.Error("Initial Matrix sync failed: ", err)
+		if !t.backoff(failures) {
+			return nil
+		}
+	}
+
+	failures := 0
+	for {
+		select {
+		case <-t.done:
+			return nil
+		default:
+		}
+		batch, err := t.sync(since, t.syncTimeout)
+		if err != nil {
+			failures++
+			log.Error("Matrix sync failed: ", err)
+			if !t.backoff(failures) {
+				return nil
+			}
+			continue
+		}
+		failures = 0
+		t.processSync(batch, handle)
+		since = batch.NextBatch
+	}
+}
+
+// backoff waits retryDelay doubled for every failure in a row (up to maxRetryDelay),
+// returns false if transport was closed in the meantime
+func (t *matrixTransport) backoff(failures int) bool {
+	delay := t.retryDelay
+	for i := 1; i < failures && delay < t.maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > t.maxRetryDelay {
+		delay = t.maxRetryDelay
+	}
+	return t.wait(delay)
+}
+
+// wait sleeps for the given duration, returns false if transport was closed in the meantime
+func (t *matrixTransport) wait(d time.Duration) bool {
+	select {
+	case <-t.done:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+func (t *matrixTransport) login() error {
+	if t.accessToken == "" {
+		var resp struct {
+			AccessToken string `json:"access_token"`
+			UserID      string `json:"user_id"`
+		}
+		err := t.do("POST", "/login", map[string]interface{}{
+			"type":                        "m.login.password",
+			"identifier":                  map[string]string{"type": "m.id.user", "user": config.MatrixUser},
+			"user":                        config.MatrixUser,
+			"password":                    config.MatrixPassword,
+			"initial_device_display_name": "meowkov",
+		}, &resp)
+		if err != nil {
+			return err
+		}
+		t.accessToken = resp.AccessToken
+		t.userID = resp.UserID
+	} else {
+		var resp struct {
+			UserID string `json:"user_id"`
+		}
+		if err := t.do("GET", "/account/whoami", nil, &resp); err != nil {
+			return err
+		}
+		t.userID = resp.UserID
+	}
+
+	var profile struct {
+		DisplayName string `json:"displayname"`
+	}
+	if err := t.do("GET", "/profile/"+url.PathEscape(t.userID)+"/displayname", nil, &profile); err != nil {
+		log.Warn("Unable to read Matrix display name: ", err)
+	}
+	t.setDisplayName(profile.DisplayName)
+	log.Println("Logged into Matrix as " + t.userID + " (" + t.nick() + ")")
+	return nil
+}
+
+func (t *matrixTransport) join(room string) error {
+	var resp struct {
+		RoomID string `json:"room_id"`
+	}
+	if err := t.do("POST", "/join/"+url.PathEscape(room), struct{}{}, &resp); err != nil {
+		return err
+	}
+	log.Println("Joined Matrix room " + room + " (" + resp.RoomID + ")")
+	return nil
+}
+
+func (t *matrixTransport) sync(since string, timeout time.Duration) (*matrixSync, error) {
+	query := url.Values{}
+	query.Set("timeout", fmt.Sprint(int64(timeout/time.Millisecond)))
+	if since != "" {
+		query.Set("since", since)
+	}
+	var batch matrixSync
+	err := t.do("GET", "/sync?"+query.Encode(), nil, &batch)
+	return &batch, err
+}
+
+// processSync updates room state and passes new messages to the handler (if present)
+func (t *matrixTransport) processSync(batch *matrixSync, handle func(message)) {
+	for _, event := range batch.AccountData.Events {
+		if event.Type == "m.direct" {
+			var direct map[string][]string
+			if json.Unmarshal(event.Content, &direct) == nil {
+				t.mtx.Lock()
+				t.direct = direct
+				t.mtx.Unlock()
+			}
+		}
+	}
+	for room, data := range batch.Rooms.Invite {
+		if err := t.join(room); err != nil {
+			log.Error("Unable to accept invite to Matrix room "+room+": ", err)
+			continue
+		}
+		if inviter := t.directInviter(data.InviteState); inviter != "" {
+			t.addDirect(inviter, room)
+		}
+	}
+	for room, data := range batch.Rooms.Join {
+		for _, event := range data.State.Events {
+			t.processMember(room, event)
+		}
+		for _, event := range data.Timeline.Events {
+			t.processMember(room, event)
+			if handle == nil || event.Type != "m.room.message" || event.Sender == t.userID {
+				continue
+			}
+			var content struct {
+				MsgType string `json:"msgtype"`
+				Body    string `json:"body"`
+			}
+			if json.Unmarshal(event.Content, &content) != nil {
+				continue
+			}
+			if content.MsgType != "m.text" && content.MsgType != "m.emote" {
+				continue
+			}
+			private := t.isPrivate(room)
+			handle(message{
+				source:     room,
+				nick:       t.memberName(room, event.Sender),
+				text:       content.Body,
+				private:    private,
+				learn:      !private,
+				receivedAt: time.Now(),
+			})
+		}
+	}
+}
+
+// processMember keeps track of display names used for mentions
+func (t *matrixTransport) processMember(room string, event matrixEvent) {
+	if event.Type != "m.room.member" || event.StateKey == nil {
+		return
+	}
+	var content struct {
+		Membership  string `json:"membership"`
+		DisplayName string `json:"displayname"`
+	}
+	if json.Unmarshal(event.Content, &content) != nil {
+		return
+	}
+	user := *event.StateKey
+	if user == t.userID && content.DisplayName != "" {
+		t.setDisplayName(content.DisplayName)
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.members[room] == nil {
+		t.members[room] = make(map[string]string)
+	}
+	if content.Membership == "join" {
+		t.members[room][user] = content.DisplayName
+	} else {
+		delete(t.members[room], user)
+	}
+}
+
+// isPrivate tells if the room is a direct chat (listed in m.direct account data)
+func (t *matrixTransport) isPrivate(room string) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	for _, rooms := range t.direct {
+		if contains(rooms, room) {
+			return true
+		}
+	}
+	return false
+}
+
+// directInviter returns the user who invited us to a direct chat (is_direct flag of the invite), if any
+func (t *matrixTransport) directInviter(state matrixEvents) string {
+	for _, event := range state.Events {
+		if event.Type != "m.room.member" || event.StateKey == nil || *event.StateKey != t.userID {
+			continue
+		}
+		var content struct {
+			IsDirect bool `json:"is_direct"`
+		}
+		if json.Unmarshal(event.Content, &content) == nil && content.IsDirect {
+			return event.Sender
+		}
+	}
+	return ""
+}
+
+// addDirect records a direct chat with the user in m.direct account data,
+// so it is recognized after restart (and by other clients) as well
+func (t *matrixTransport) addDirect(user string, room string) {
+	t.mtx.Lock()
+	direct := make(map[string][]string, len(t.direct)+1)
+	for u, rooms := range t.direct {
+		direct[u] = rooms
+	}
+	if !contains(direct[user], room) {
+		direct[user] = append(append([]string{}, direct[user]...), room)
+	}
+	t.direct = direct
+	t.mtx.Unlock()
+
+	path := "/user/" + url.PathEscape(t.userID) + "/account_data/m.direct"
+	if err := t.do("PUT", path, direct, nil); err != nil {
+		log.Error("Unable to update Matrix direct chats: ", err)
+	}
+}
+
+func (t *matrixTransport) memberName(room string, user string) string {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if name := t.members[room][user]; name != "" {
+		return name
+	}
+	return matrixLocalpart(user)
+}
+
+func (t *matrixTransport) setDisplayName(name string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if name == "" {
+		name = matrixLocalpart(t.userID)
+	}
+	t.displayName = name
+}
+
+func (t *matrixTransport) nick() string {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.displayName
+}
+
+func (t *matrixTransport) message(target string, text string) {
+	t.send(target, "m.text", text)
+}
+
+func (t *matrixTransport) action(target string, text string) {
+	t.send(target, "m.emote", text)
+}
+
+func (t *matrixTransport) send(room string, msgType string, text string) {
+	txn := fmt.Sprintf("meowkov.%d.%d", time.Now().UnixNano(), atomic.AddInt64(&t.txn, 1))
+	path := "/rooms/" + url.PathEscape(room) + "/send/m.room.message/" + txn
+	content := map[string]string{"msgtype": msgType, "body": text}
+	if err := t.do("PUT", path, content, nil); err != nil {
+		log.Error("Unable to send Matrix message to "+room+": ", err)
+	}
+}
+
+func (t *matrixTransport) close() {
+	select {
+	case <-t.done:
+	default:
+		log.Warn("Disconnecting from Matrix")
+		close(t.done)
+	}
+}
+
+// do performs a single call to the client-server API
+func (t *matrixTransport) do(method string, path string, body interface{}, result interface{}) error {
+	var payload io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, t.homeserver+matrixAPI+path, payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if t.accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+t.accessToken)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var matrixErr struct {
+			ErrCode string `json:"errcode"`
+			Error   string `json:"error"`
+		}
+		json.Unmarshal(data, &matrixErr)
+		return errors.New(resp.Status + " " + matrixErr.ErrCode + ": " + matrixErr.Error)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(data, result)
+}
+
+// @meowkov:example.org → meowkov
+func matrixLocalpart(userID string) string {
+	localpart := strings.TrimPrefix(userID, "@")
+	if i := strings.Index(localpart, ":"); i >= 0 {
+		localpart = localpart[:i]
+	}
+	return localpart
+}
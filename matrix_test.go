@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeHomeserver implements just enough of the client-server API for matrixTransport
+type fakeHomeserver struct {
+	mtx    sync.Mutex
+	down   int // number of logins to fail
+	joined []string
+	sent   []map[string]string
+	direct map[string][]string
+	syncs  int
+}
+
+func (hs *fakeHomeserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hs.mtx.Lock()
+	defer hs.mtx.Unlock()
+
+	path := strings.TrimPrefix(r.URL.EscapedPath(), matrixAPI)
+	if path != "/login" && r.Header.Get("Authorization") != "Bearer secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"errcode":"M_UNKNOWN_TOKEN","error":"bad token"}`))
+		return
+	}
+	switch {
+	case path == "/login" && hs.down > 0:
+		hs.down--
+		w.WriteHeader(http.StatusBadGateway)
+	case path == "/login":
+		w.Write([]byte(`{"access_token":"secret","user_id":"@meowkov:example.org"}`))
+	case strings.HasPrefix(path, "/profile/"):
+		w.Write([]byte(`{"displayname":"Meow Kov"}`))
+	case strings.HasPrefix(path, "/join/"):
+		hs.joined = append(hs.joined, strings.TrimPrefix(r.URL.Path, matrixAPI+"/join/"))
+		w.Write([]byte(`{"room_id":"!room:example.org"}`))
+	case strings.HasSuffix(path, "/account_data/m.direct") && r.Method == "PUT":
+		data, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(data, &hs.direct)
+		w.Write([]byte(`{}`))
+	case strings.HasPrefix(path, "/rooms/") && r.Method == "PUT":
+		var content map[string]string
+		data, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(data, &content)
+		hs.sent = append(hs.sent, content)
+		w.Write([]byte(`{"event_id":"$sent"}`))
+	case path == "/sync":
+		hs.syncs++
+		switch hs.syncs {
+		case 1: // initial sync: history that should be ignored
+			w.Write([]byte(`{"next_batch":"s1",
+				"account_data":{"events":[{"type":"m.direct","content":{"@bob:example.org":["!dm:example.org"]}}]},
+				"rooms":{"join":{"!room:example.org":{
+				"state":{"events":[
+					{"type":"m.room.member","sender":"@alice:example.org","state_key":"@alice:example.org","content":{"membership":"join","displayname":"Alice"}}
+				]},
+				"timeline":{"events":[
+					{"type":"m.room.message","sender":"@alice:example.org","content":{"msgtype":"m.text","body":"old message"}}
+				]}}}}}`))
+		case 2:
+			w.Write([]byte(`{"next_batch":"s2","rooms":{"join":{
+				"!room:example.org":{"timeline":{"events":[
+					{"type":"m.room.message","sender":"@meowkov:example.org","content":{"msgtype":"m.text","body":"own message"}},
+					{"type":"m.room.message","sender":"@alice:example.org","content":{"msgtype":"m.text","body":"Meow Kov: hello"}},
+					{"type":"m.room.message","sender":"@alice:example.org","content":{"msgtype":"m.image","body":"cat.png"}}
+				]}},
+				"!dm:example.org":{"timeline":{"events":[
+					{"type":"m.room.message","sender":"@bob:example.org","content":{"msgtype":"m.text","body":"psst"}}
+				]}},
+				"!small:example.org":{"summary":{"m.joined_member_count":2},"timeline":{"events":[
+					{"type":"m.room.message","sender":"@carol:example.org","content":{"msgtype":"m.text","body":"just us"}}
+				]}}},
+				"invite":{"!new:example.org":{"invite_state":{"events":[
+					{"type":"m.room.member","sender":"@dave:example.org","state_key":"@meowkov:example.org","content":{"membership":"invite","is_direct":true}}
+				]}}}}}`))
+		default:
+			w.Write([]byte(`{"next_batch":"s3"}`))
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestMatrixTransport(t *testing.T) {
+	userOrig, roomsOrig := config.MatrixUser, config.MatrixRooms
+	config.MatrixUser = "meowkov"
+	config.MatrixRooms = []string{"#cats:example.org"}
+	defer func() { config.MatrixUser, config.MatrixRooms = userOrig, roomsOrig }()
+
+	hs := &fakeHomeserver{down: 2}
+	server := httptest.NewServer(hs)
+	defer server.Close()
+
+	matrix := newMatrixTransport(server.URL)
+	matrix.syncTimeout = 10 * time.Millisecond
+	matrix.retryDelay = 10 * time.Millisecond
+	matrix.maxRetryDelay = 20 * time.Millisecond
+
+	received := make(chan message, 10)
+	finished := make(chan error)
+	go func() {
+		finished <- matrix.run(func(m message) { received <- m })
+	}()
+
+	var messages []message
+	for len(messages) < 3 {
+		select {
+		case m := <-received:
+			messages = append(messages, m)
+		case <-time.After(2 * time.Second):
+			t.Fatal("matrixTransport did not deliver messages in time")
+		}
+	}
+	matrix.close()
+	if err := <-finished; err != nil {
+		t.Error("matrixTransport.run should finish cleanly after close: " + err.Error())
+	}
+
+	if matrix.nick() != "Meow Kov" {
+		t.Error("matrixTransport should use display name as nick, got: " + matrix.nick())
+	}
+	if len(hs.joined) != 2 || hs.joined[0] != "#cats:example.org" {
+		t.Errorf("matrixTransport should join configured rooms, joined: %v", hs.joined)
+	}
+
+	bySource := make(map[string]message)
+	for _, m := range messages {
+		bySource[m.source] = m
+	}
+	channelMsg, privateMsg, smallMsg := bySource["!room:example.org"], bySource["!dm:example.org"], bySource["!small:example.org"]
+	if channelMsg.nick != "Alice" || channelMsg.text != "Meow Kov: hello" || channelMsg.private || !channelMsg.learn {
+		t.Errorf("unexpected room message: %#v", channelMsg)
+	}
+	if privateMsg.nick != "bob" || !privateMsg.private || privateMsg.learn {
+		t.Errorf("unexpected direct message: %#v", privateMsg)
+	}
+	if smallMsg.text != "just us" || smallMsg.private || !smallMsg.learn {
+		t.Errorf("small rooms not listed in m.direct should not be private: %#v", smallMsg)
+	}
+	if !matrix.isPrivate("!new:example.org") || !contains(hs.direct["@dave:example.org"], "!new:example.org") ||
+		!contains(hs.direct["@bob:example.org"], "!dm:example.org") {
+		t.Errorf("invites to direct chats should be recorded in m.direct: %v", hs.direct)
+	}
+	if calculateChattiness(channelMsg.text, matrix.nick(), channelMsg.private) != always {
+		t.Error("mention of Matrix display name should be detected")
+	}
+
+	matrix.message("!room:example.org", "meow")
+	matrix.action("!room:example.org", "purrs")
+	if len(hs.sent) != 2 ||
+		hs.sent[0]["msgtype"] != "m.text" || hs.sent[0]["body"] != "meow" ||
+		hs.sent[1]["msgtype"] != "m.emote" || hs.sent[1]["body"] != "purrs" {
+		t.Errorf("matrixTransport sent unexpected messages: %v", hs.sent)
+	}
+}
+
+func TestMatrixLocalpart(t *testing.T) {
+	if matrixLocalpart("@meowkov:example.org") != "meowkov" {
+		t.Error("matrixLocalpart should strip sigil and server name")
+	}
+}
@@ -3,7 +3,9 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -11,13 +13,11 @@ import (
 	"math/rand"
 	"net"
 	"os"
-	"os/signal"
 	"regexp"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/fiam/gounidecode/unidecode"
 	"github.com/garyburd/redigo/redis"
-	"github.com/thoj/go-ircevent"
 
 	"reflect"
 	"runtime"
@@ -25,7 +25,6 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
-	"syscall"
 	"time"
 )
 
@@ -37,13 +36,78 @@ var config struct {
 	UseTLS      bool
 	Debug       bool
 
-	RedisServer string
+	IrcSASLMechanism string
+	IrcSASLLogin     string
+	IrcSASLPassword  string
+	IrcClientCert    string
+	IrcClientKey     string
+	NickServPassword string
+	IrcAuthTimeout   int64
+
+	AlternateNicks     []string
+	NickAliases        []string
+	NickRegainInterval int64
+	NickRegainCommand  string
+
+	IrcReconnectDelay    int64
+	IrcMaxReconnectDelay int64
+	IrcMaxReconnects     int64
+
+	IrcFloodBurst int64
+	IrcFloodRate  float64
+
+	MatrixHomeserver  string
+	MatrixUser        string
+	MatrixPassword    string
+	MatrixAccessToken string
+	MatrixRooms       []string
+
+	RedisServer           string
+	RedisUser             string
+	RedisPassword         string
+	RedisDatabase         int64
+	RedisTLS              bool
+	RedisTLSCA            string
+	RedisTLSSkipVerify    bool
+	RedisSentinels        []string
+	RedisSentinelMaster   string
+	RedisSentinelPassword string
+	RedisConnectTimeout   int64 // milliseconds
+	RedisReadTimeout      int64 // milliseconds
+	RedisWriteTimeout     int64 // milliseconds
+	RedisMaxIdle          int64
+	RedisMaxActive        int64
+	RedisIdleTimeout      int64
+
+	SpoolFile           string
+	SpoolMaxSize        int64
+	SpoolReplayInterval int64
+
+	CacheSize int64
+	CacheTTL  int64
+
+	StatsAddress  string
+	SettingsToken string
 
 	ChainLength      int64
+	ChainLengths     []int64
+	MinFollowers     int64
 	MaxChainLength   int64
 	ChainsToTry      int64
 	MinResponsePool  int64
 	MaxResponseTries int64
+	WalkMode         string
+	GenerationMode   string
+	BeamWidth        int64
+	BeamBranching    int64
+
+	Workers             int64
+	MaxQueuedPerChannel int64
+	MaxMessageAge       int64
+	GenerationTimeout   int64 // milliseconds
+	ShutdownTimeout     int64
+	SaveTimeout         int64
+	QuitMessage         string
 
 	DefaultChattiness       float64
 	MinTimeBetweenReactions int64
@@ -55,12 +119,44 @@ var config struct {
 	DontEndWith         []string
 	Blacklist           []string
 
+	UnbalancedPunctuation string
+
+	ParrotIndex     bool
+	ParrotWindow    int64
+	MaxCopiedTokens int64
+
+	Sampling    bool
+	Temperature float64
+	TopK        int64
+	TopP        float64
+	MinLength   int64
+
+	ChannelSettings map[string]channelSettings
+
+	StopwordFrequency float64
+
+	ContextMessages   int64
+	ShortMessageWords int64
+	ThreadWindow      int64
+	ThreadChattiness  float64
+
+	RecentResponses     int64
+	RecentSimilarity    float64
+	RecentResponsesFile string
+
+	ScoreWeights         map[string]float64
+	TargetLength         int64
+	SelectionPolicy      string
+	SelectionTemperature float64
+
 	RoomName string `json:",omitempty"` // deprecated
 }
 
 const (
 	stop          = "\x01"
 	separator     = "\x02"
+	start         = "\x03"
+	openingsKey   = start + separator + start // set of sentence openings (can't collide with chains, start appears once per message)
 	always        = 1.0
 	defaultConfig = "meowkov.conf"
 )
@@ -71,19 +167,22 @@ var (
 	version      string
 
 	ownMention    *regexp.Regexp
+	ownMentionKey string
+	ownMentionMtx sync.Mutex
 	otherMention  *regexp.Regexp
 	httpLink      *regexp.Regexp
-	textCruft     *regexp.Regexp
+	ircFormatting *regexp.Regexp
 	emoticonCruft *regexp.Regexp
 )
 
 type uniqueTexts map[string]struct{}
 
-func loadConfig(file string) (bool, bool) {
+func loadConfig(file string) (bool, bool, bool) {
 	var (
 		confPath    = flag.String("c", file, "path to the config file")
 		justImport  = flag.Bool("import", false, "If true, read messages from piped stdin instead of IRC")
 		purgeCorpus = flag.Bool("purge", false, "If true, removes old corpus before importing anything")
+		console     = flag.Bool("console", false, "If true, chat with the bot on stdin/stdout instead of IRC")
 		errorPrefix = "Error during loadConfig(): "
 	)
 	flag.Parse()
@@ -92,6 +191,8 @@ func loadConfig(file string) (bool, bool) {
 
 	jsonData, confError := ioutil.ReadFile(*confPath)
 	check(confError, errorPrefix)
+	// options where 0 disables something are negative (unset) unless present in the config file
+	config.StopwordFrequency, config.ThreadChattiness, config.RecentSimilarity, config.Temperature = -1, -1, -1, -1
 	confError = json.Unmarshal(jsonData, &config)
 	check(confError, errorPrefix)
 
@@ -100,7 +201,7 @@ func loadConfig(file string) (bool, bool) {
 		//log.Debugf("%#v\n", config)
 		c := reflect.ValueOf(&config).Elem()
 		t := c.Type()
-		secret := regexp.MustCompile("(?i)password")
+		secret := regexp.MustCompile("(?i)password|token")
 		for i := 0; i < c.NumField(); i++ {
 			f := c.Field(i)
 			value := f.Interface()
@@ -112,38 +213,11 @@ func loadConfig(file string) (bool, bool) {
 		}
 	}
 
-	// init Redis
-	redisServer := getRedisServer()
-	log.Println("Connecting to Redis at " + redisServer)
-	pool = &redis.Pool{
-		MaxIdle:     3,
-		MaxActive:   10,
-		Wait:        true,
-		IdleTimeout: 240 * time.Second,
-		Dial: func() (redis.Conn, error) {
-			timeout := 500 * time.Millisecond
-			c, err := redis.Dial("tcp", redisServer,
-				redis.DialConnectTimeout(timeout),
-				redis.DialReadTimeout(timeout),
-				redis.DialWriteTimeout(timeout))
-			if err != nil {
-				return nil, err
-			}
-			return c, err
-		},
-		TestOnBorrow: func(c redis.Conn, t time.Time) error {
-			// ping connections that were idle more than a minute
-			if time.Since(t) < time.Minute {
-				return nil
-			}
-			_, err := c.Do("PING")
-			return err
-		},
-	}
-
 	// irc server validation
-	_, _, hostError := net.SplitHostPort(config.IrcServer)
-	check(hostError, errorPrefix)
+	if config.IrcServer != "" {
+		_, _, hostError := net.SplitHostPort(config.IrcServer)
+		check(hostError, errorPrefix)
+	}
 
 	// support legacy configs
 	if len(config.Channels) == 0 && config.RoomName != "" {
@@ -151,32 +225,223 @@ func loadConfig(file string) (bool, bool) {
 		config.Channels = []string{config.RoomName}
 	}
 
+	// defaults for options missing in older config files
+	if config.RedisConnectTimeout <= 0 {
+		config.RedisConnectTimeout = 500
+	}
+	if config.RedisReadTimeout <= 0 {
+		config.RedisReadTimeout = 500
+	}
+	if config.RedisWriteTimeout <= 0 {
+		config.RedisWriteTimeout = 500
+	}
+	if config.RedisMaxIdle <= 0 {
+		config.RedisMaxIdle = 3
+	}
+	if config.RedisMaxActive <= 0 {
+		config.RedisMaxActive = 10
+	}
+	if config.RedisIdleTimeout <= 0 {
+		config.RedisIdleTimeout = 240
+	}
+	if config.SpoolFile == "" {
+		config.SpoolFile = "meowkov.spool"
+	}
+	if config.SpoolMaxSize <= 0 {
+		config.SpoolMaxSize = 10000
+	}
+	if config.SpoolReplayInterval <= 0 {
+		config.SpoolReplayInterval = 10
+	}
+	if config.CacheTTL <= 0 {
+		config.CacheTTL = 60
+	}
+	if config.IrcAuthTimeout <= 0 {
+		config.IrcAuthTimeout = 15
+	}
+	if config.NickRegainInterval == 0 {
+		config.NickRegainInterval = 120
+	}
+	if config.NickRegainCommand == "" {
+		config.NickRegainCommand = "REGAIN"
+	}
+	if config.IrcReconnectDelay <= 0 {
+		config.IrcReconnectDelay = 5
+	}
+	if config.IrcMaxReconnectDelay < config.IrcReconnectDelay {
+		config.IrcMaxReconnectDelay = 600
+	}
+	if config.IrcFloodBurst <= 0 {
+		config.IrcFloodBurst = 4
+	}
+	if config.IrcFloodRate <= 0 {
+		config.IrcFloodRate = 0.5
+	}
+	if !containsOrder(config.ChainLengths, config.ChainLength) {
+		config.ChainLengths = append(config.ChainLengths, config.ChainLength)
+	}
+	// longest order first
+	sort.Slice(config.ChainLengths, func(i, j int) bool { return config.ChainLengths[i] > config.ChainLengths[j] })
+	if config.MinFollowers <= 0 {
+		config.MinFollowers = 2
+	}
+	if config.WalkMode == "" {
+		// server-side walks can't use the cache
+		config.WalkMode = serverWalk
+		if config.CacheSize > 0 {
+			config.WalkMode = clientWalk
+		}
+	}
+	if config.WalkMode != serverWalk && config.WalkMode != clientWalk {
+		log.Fatalln("Unknown 'WalkMode': " + config.WalkMode + " (expected '" + serverWalk + "' or '" + clientWalk + "')")
+	}
+	if config.WalkMode == serverWalk && config.CacheSize > 0 {
+		log.Warn("'CacheSize' is set, but server-side walks ('WalkMode': '" + serverWalk + "') don't use the cache")
+	}
+	if config.GenerationMode == "" {
+		config.GenerationMode = walkGeneration
+	}
+	if config.GenerationMode != walkGeneration && config.GenerationMode != beamGeneration {
+		log.Fatalln("Unknown 'GenerationMode': " + config.GenerationMode + " (expected '" + walkGeneration + "' or '" + beamGeneration + "')")
+	}
+	if config.BeamWidth <= 0 {
+		config.BeamWidth = 8
+	}
+	if config.BeamBranching <= 0 {
+		config.BeamBranching = 4
+	}
+	if config.UnbalancedPunctuation == "" {
+		config.UnbalancedPunctuation = repairUnbalanced
+	}
+	if config.UnbalancedPunctuation != repairUnbalanced && config.UnbalancedPunctuation != rejectUnbalanced {
+		log.Fatalln("Unknown 'UnbalancedPunctuation': " + config.UnbalancedPunctuation + " (expected '" + repairUnbalanced + "' or '" + rejectUnbalanced + "')")
+	}
+	if config.ParrotWindow <= 0 {
+		config.ParrotWindow = 4
+	}
+	if config.Temperature < 0 {
+		config.Temperature = 1
+	}
+	overrides := make(map[string]channelSettings)
+	for channel, override := range config.ChannelSettings {
+		overrides[strings.ToLower(channel)] = override
+	}
+	config.ChannelSettings = overrides
+	if config.StopwordFrequency < 0 {
+		config.StopwordFrequency = 0.05
+	}
+	if config.ContextMessages <= 0 {
+		config.ContextMessages = 5
+	}
+	if config.ShortMessageWords <= 0 {
+		config.ShortMessageWords = 2
+	}
+	if config.ThreadWindow <= 0 {
+		config.ThreadWindow = 60
+	}
+	if config.ThreadChattiness < 0 {
+		config.ThreadChattiness = 0.2
+	}
+	if config.RecentResponses <= 0 {
+		config.RecentResponses = 10
+	}
+	if config.RecentSimilarity < 0 {
+		config.RecentSimilarity = 0.8
+	}
+	if config.ScoreWeights == nil {
+		config.ScoreWeights = map[string]float64{"overlap": 1, "verbatim": 1, "repetition": 1, "length": 0.5, "novelty": 1}
+	}
+	for name := range config.ScoreWeights {
+		if _, ok := scorers[name]; !ok {
+			log.Fatalln("Unknown scorer in 'ScoreWeights': " + name)
+		}
+	}
+	if config.TargetLength <= 0 {
+		config.TargetLength = 12
+	}
+	if config.SelectionPolicy == "" {
+		config.SelectionPolicy = selectSoftmax
+	}
+	if config.SelectionPolicy != selectRandom && config.SelectionPolicy != selectArgmax && config.SelectionPolicy != selectSoftmax {
+		log.Fatalln("Unknown 'SelectionPolicy': " + config.SelectionPolicy)
+	}
+	if config.SelectionTemperature <= 0 {
+		config.SelectionTemperature = 0.3
+	}
+	if config.Workers <= 0 {
+		config.Workers = int64(runtime.NumCPU())
+	}
+	if config.MaxQueuedPerChannel <= 0 {
+		config.MaxQueuedPerChannel = 3
+	}
+	if config.MaxMessageAge <= 0 {
+		config.MaxMessageAge = 60
+	}
+	if config.GenerationTimeout <= 0 {
+		config.GenerationTimeout = 3000
+	}
+	if config.ShutdownTimeout <= 0 {
+		config.ShutdownTimeout = 10
+	}
+	if config.SaveTimeout <= 0 {
+		config.SaveTimeout = 60
+	}
+
+	// init Redis
+	pool = newRedisPool()
+	var spoolErr error
+	corpusSpool, spoolErr = openSpool(config.SpoolFile, int(config.SpoolMaxSize))
+	check(spoolErr, "Unable to open spool "+config.SpoolFile+": ")
+	go corpusSpool.replayLoop(time.Duration(config.SpoolReplayInterval) * time.Second)
+
+	history = newConversation(int(config.ContextMessages))
+	recent = newRecentResponses(int(config.RecentResponses), config.RecentResponsesFile)
+
+	if config.CacheSize > 0 {
+		followers = newFollowerCache(int(config.CacheSize), time.Duration(config.CacheTTL)*time.Second)
+	}
+
+	if config.StatsAddress != "" {
+		go serveStats(config.StatsAddress)
+	}
+
 	// other inits
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	rand.Seed(time.Now().Unix())
 	lastReaction = time.Now().UnixNano()
 
-	// detect when own nick is mentioned or when message is directed to other person
-	ownMention = regexp.MustCompile("(?i)_*" + regexp.QuoteMeta(config.BotName) + "_*[:,]*\\s*")
+	// detect when message is directed to other person (own mentions are detected by ownMentionRegexp)
 	otherMention = regexp.MustCompile(`(?i)^\S+[:,]+\s+`)
 	// detect HTTP(s) URLs
 	httpLink = regexp.MustCompile("^http(s)?://[^/]")
-	// remove single and double quotes, parentheses and ?!, leave semicolons and commas
-	textCruft = regexp.MustCompile(`^[„“\"'\(\[]*([^\"'\?!\)\]„“”]+)[”“\"'\?!\)\]]*$`)
+	// remove IRC formatting (colors, bold etc.) and other control characters
+	ircFormatting = regexp.MustCompile(`\x03(\d{1,2}(,\d{1,2})?)?|[\x00-\x1f]`)
 	// remove emoticons
 	emoticonCruft = regexp.MustCompile(`^([;:8]["'-^]*[\[\(\]\)<DPdoOcCp]+)$`)
 
-	return *justImport, *purgeCorpus
+	return *justImport, *purgeCorpus, *console
 }
 
 func main() {
-	justImport, mode := loadConfig(defaultConfig)
+	justImport, mode, console := loadConfig(defaultConfig)
 	defer pool.Close()
 
 	if justImport {
 		importLoop(mode)
+	} else if console {
+		chatLoop(newConsoleTransport(os.Stdin, os.Stdout))
 	} else {
-		ircLoop()
+		var transports []transport
+		if config.IrcServer != "" {
+			transports = append(transports, newIrcTransport())
+		}
+		if config.MatrixHomeserver != "" {
+			transports = append(transports, newMatrixTransport(config.MatrixHomeserver))
+		}
+		if len(transports) == 0 {
+			log.Fatalln("Nothing to connect to: set 'IrcServer' and/or 'MatrixHomeserver' in the config file")
+		}
+		chatLoop(transports...)
 	}
 }
 
@@ -223,118 +488,6 @@ func importLoop(newCorpus bool) {
 
 }
 
-func ircLoop() {
-	con := irc.IRC(config.BotName, config.BotName)
-	con.UseTLS = config.UseTLS
-	con.Debug = config.Debug
-	con.Version = "meowkov @ " + version + " (https://github.com/lidel/meowkov)"
-	if config.IrcPassword != "" {
-		con.Password = config.IrcPassword
-	}
-
-	log.Println("Connecting to IRC at " + config.IrcServer)
-	con.Connect(config.IrcServer)
-
-	con.AddCallback("001", func(e *irc.Event) {
-		for _, channel := range config.Channels {
-			con.Join(channel)
-		}
-	})
-
-	con.AddCallback("JOIN", func(e *irc.Event) {
-		if react(config.DefaultChattiness) {
-			room, _ := inputSource(e.Raw, con.GetNick())
-			con.Privmsg(room, randomSmiley())
-			bumpLastReaction()
-		}
-	})
-
-	// thin wrapper responsible for sending IRC messages
-	privmsg := func(source string, nick string, message string, triggeredAt time.Time, prefixWithNick bool) {
-		response := strings.TrimSpace(message)
-		typingDelay(response, triggeredAt)
-		if strings.HasPrefix(response, "/me ") {
-			con.Action(source, strings.Replace(response, "/me ", "", 1))
-		} else {
-			if prefixWithNick {
-				response = nick + ": " + response
-			}
-			con.Privmsg(source, response)
-		}
-	}
-
-	con.AddCallback("PRIVMSG", func(e *irc.Event) {
-		// response takes some work, running in a new thread
-		go func(e *irc.Event) {
-			start := time.Now()
-			ownNick := con.GetNick()
-			source, privateQuery := inputSource(e.Raw, ownNick)
-			input := strings.TrimSpace(e.Message())
-
-			if response := predefinedResponse(input); response != "" {
-				bumpLastReaction()
-				privmsg(source, e.Nick, response, start, !privateQuery)
-				return // finish processing input
-			}
-
-			// fallback to markov-based generator
-			words, seeds := processInput(input, !privateQuery)
-			chattiness := calculateChattiness(input, ownNick, privateQuery)
-			if react(chattiness) {
-				bumpLastReaction()
-				response := generateResponse(words, seeds, int(config.MaxResponseTries))
-				prefixWithNick := chattiness == always && !privateQuery
-				privmsg(source, e.Nick, response, start, prefixWithNick)
-			}
-		}(e)
-	})
-
-	quitEvent := regexp.MustCompile("^:([^!]+)!.+QUIT")
-	con.AddCallback("QUIT", func(e *irc.Event) {
-		go func(e *irc.Event) {
-			ownNick := con.GetNick()
-			quitNick := quitEvent.FindStringSubmatch(e.Raw)[1]
-			if ownNick == quitNick && strings.Contains(e.Raw, "Ping timeout") {
-				log.Println("Timeout detected, reconnecting to " + config.IrcServer)
-				con.Reconnect()
-			}
-		}(e)
-	})
-
-	// proces termination signal triggers cleanup
-	sc := make(chan os.Signal)
-	signal.Notify(sc, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
-	go func() {
-		sig := <-sc
-		log.Warn("Received '", sig, "' signal, shutting down")
-		exitCode := 0
-
-		// persist corpus to disk
-		log.Info("Saving the Corpus")
-		defer pool.Close()
-		corpus := pool.Get()
-		defer corpus.Close()
-		_, err := corpus.Do("SAVE")
-		if err == nil {
-			log.Info("Saved to dump.rdb")
-		} else {
-			log.Error("Unable to save Corpus: ", err)
-			exitCode = 1
-		}
-
-		// disconnect
-		if con.Connected() {
-			log.Warn("Disconnecting from IRC")
-			con.Quit()
-			con.Disconnect()
-		}
-		os.Exit(exitCode)
-	}()
-
-	con.Loop()
-	log.Panic("The IRC Loop finished prematurely")
-}
-
 // decides if there should be a reaction given current chattiness level
 func react(chattiness float64) bool {
 	return chattiness == always || (chattiness > rand.Float64() && withinReactionRate())
@@ -348,23 +501,34 @@ func withinReactionRate() bool {
 	return atomic.LoadInt64(&lastReaction) < time.Now().Add(-time.Duration(config.MinTimeBetweenReactions)*time.Second).UnixNano()
 }
 
-func inputSource(raw string, ownNick string) (string, bool) {
-	channel := strings.Split(raw, " ")[2]
-	privateQuery := channel == ownNick
-	if privateQuery {
-		channel = strings.Split(raw[1:], "!")[0]
-	}
-	return channel, privateQuery
-}
-
 func calculateChattiness(message string, currentBotNick string, privateQuery bool) float64 {
 	chattiness := config.DefaultChattiness
-	if privateQuery || strings.Contains(message, currentBotNick) || ownMention.MatchString(message) {
+	if privateQuery || ownMentionRegexp(currentBotNick).MatchString(message) {
 		chattiness = always
 	}
 	return chattiness
 }
 
+// ownMentionRegexp detects when bot is mentioned by its current nick, BotName or one of NickAliases
+// (regexp is recompiled only when current nick changes)
+func ownMentionRegexp(currentBotNick string) *regexp.Regexp {
+	var names []string
+	for _, name := range append([]string{currentBotNick, config.BotName}, config.NickAliases...) {
+		if name != "" && !contains(names, regexp.QuoteMeta(name)) {
+			names = append(names, regexp.QuoteMeta(name))
+		}
+	}
+	key := strings.Join(names, "|")
+
+	ownMentionMtx.Lock()
+	defer ownMentionMtx.Unlock()
+	if ownMention == nil || ownMentionKey != key {
+		ownMention = regexp.MustCompile("(?i)_*(" + key + ")_*[:,]*\\s*")
+		ownMentionKey = key
+	}
+	return ownMention
+}
+
 func getRedisServer() string {
 	redisHost, redisPort, err := net.SplitHostPort(config.RedisServer)
 	check(err, "getRedisServer() is unable to get value from config file: ")
@@ -387,10 +551,14 @@ func isEmpty(text string) bool {
 }
 
 func isChainEmpty(texts []string) bool {
+	if len(texts) > 0 && texts[0] == start {
+		texts = texts[1:]
+	}
 	return len(texts) == 0 || (len(texts) == 1 && texts[0] == stop || texts[0] == "")
 }
 
-func typingDelay(text string, start time.Time) {
+// typingDelay simulates human typing speed, sleep is interrupted when ctx is done
+func typingDelay(ctx context.Context, text string, start time.Time) {
 	durationSoFar := time.Since(start)
 	// https://en.wikipedia.org/wiki/Words_per_minute
 	typing := time.Duration((float64(len(text))/5)/float64(config.WordsPerMinute)*60)*time.Second - durationSoFar
@@ -402,30 +570,35 @@ func typingDelay(text string, start time.Time) {
 		if config.Debug {
 			log.Println("<sleeping for " + fmt.Sprint(typing) + ">")
 		}
-		time.Sleep(typing)
+		select {
+		case <-ctx.Done():
+		case <-time.After(typing):
+		}
 	}
 }
 
 func processInput(message string, learning bool) (words []string, seed [][]string) {
 	words = parseInput(message)
 	seed = createSeeds(words)
-	if learning && int(config.ChainLength) < len(words) {
-		addToCorpus(seed)
+	if learning {
+		if lessons := learnedSeeds(words, seed); len(lessons) > 0 {
+			if opening := openingSeed(words); opening != nil {
+				lessons = append(lessons, opening)
+			}
+			addToCorpus(lessons, message)
+		}
 	}
 	return
 }
 
 func parseInput(input string) []string {
-	var (
-		tokens = strings.Split(removeMention(input), " ")
-		words  []string
-	)
-	for _, token := range tokens {
+	var words []string
+	for _, token := range tokenize(removeMention(input)) {
 		if word := normalizeWord(token); len(word) > 0 {
 			words = append(words, word)
 		}
 	}
-	return append(words, stop)
+	return append(append([]string{start}, words...), stop)
 }
 
 // remove nickname-based prefix used for mentions
@@ -436,13 +609,13 @@ func removeMention(message string) string {
 	return message
 }
 
-// normalizeWord removes various cruft from parsed text.
-// The goal is to make corpus more uniform (no duplicate clusters for multiple versions of the same word)
+// normalizeWord removes various cruft from parsed token.
+// The goal is to make corpus more uniform (no duplicate clusters for multiple versions of the same word),
+// original casing is restored by detokenize
 func normalizeWord(word string) string {
 	word = strings.TrimSpace(word)
 	if !httpLink.MatchString(word) { // don't change URLs
 		word = strings.ToLower(word)
-		word = textCruft.ReplaceAllString(word, "$1")
 		word = emoticonCruft.ReplaceAllString(word, "")
 	}
 	return word
@@ -461,9 +634,39 @@ func predefinedResponse(input string) string {
 	return ""
 }
 
-func addToCorpus(seeds [][]string) {
+// addToCorpus learns seeds of the message, spooling them to disk when Redis is unreachable
+func addToCorpus(seeds [][]string, message string) {
+	if corpusSpool != nil && corpusSpool.size() > 0 {
+		// Redis is still down (replayLoop will pick it up), keep lessons in order
+		corpusSpool.add(seeds, message)
+		return
+	}
+	err := learnLesson(seeds, message)
+	if err == nil {
+		return
+	}
+	redisErr(err)
+	if corpusSpool != nil && isConnectionErr(err) {
+		corpusSpool.add(seeds, message)
+	}
+}
+
+// learnLesson stores seeds, then casing of the message and (with ParrotIndex) its windows of tokens
+func learnLesson(seeds [][]string, message string) error {
+	if err := storeSeeds(seeds); err != nil {
+		return err
+	}
+	learnCasing(tokenize(removeMention(message)))
+	if config.ParrotIndex {
+		indexLine(parseInput(message))
+	}
+	return nil
+}
+
+func storeSeeds(seeds [][]string) error {
 	corpus := pool.Get()
 	defer corpus.Close()
+	counting := countsFollowers()
 	for i, seed := range seeds {
 
 		cut := len(seed) - 1
@@ -473,8 +676,13 @@ func addToCorpus(seeds [][]string) {
 
 		_, err := corpus.Do("SADD", key, value)
 		if err != nil {
-			redisErr(err)
-			return
+			return err
+		}
+		followers.add(key, value)
+		if counting {
+			if _, err := corpus.Do("HINCRBY", countsPrefix+key, value, 1); err != nil {
+				return err
+			}
 		}
 
 		if config.Debug {
@@ -483,19 +691,58 @@ func addToCorpus(seeds [][]string) {
 			chainValues, err := redis.Strings(corpus.Do("SMEMBERS", key))
 			if err != nil {
 				redisErr(err)
-				return
+				continue
 			}
 			log.Println("corpus #" + fmt.Sprint(i) + ":\t" + dump(chainValues))
 		}
 	}
+
+	// statistics of words (see seedBudget)
+	if words := seedWords(seeds); len(words) > 0 {
+		corpus.Send("HINCRBY", wordsKey, start, 1)
+		for _, word := range words {
+			corpus.Send("HINCRBY", wordsKey, word, 1)
+		}
+		if _, err := corpus.Do(""); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // [1 2 3 4 \x01] → [[1 2 3][2 3 4][3 4 \x01]]
 func createSeeds(words []string) [][]string {
+	return createSeedsOfOrder(words, int(config.ChainLength))
+}
+
+// learnedSeeds returns seeds of every order from ChainLengths,
+// seeds of ChainLength order are already created by processInput
+func learnedSeeds(words []string, seeds [][]string) [][]string {
+	lessons := seeds
+	for _, order := range config.ChainLengths {
+		if order != config.ChainLength {
+			lessons = append(lessons, createSeedsOfOrder(words, int(order))...)
+		}
+	}
+	return lessons
+}
+
+// openingSeed records how the sentence started: [openingsKey, words following start joined by separator]
+// (nil for ChainLength 1, as chains of start marker are openings already)
+func openingSeed(words []string) []string {
+	length := int(config.ChainLength)
+	if length < 2 || len(words) <= length || words[0] != start || contains(words[1:length], stop) {
+		return nil
+	}
+	return []string{openingsKey, strings.Join(words[1:length], separator)}
+}
+
+// createSeedsOfOrder creates chains of order+1 words (order words of the key and the follower)
+func createSeedsOfOrder(words []string, order int) [][]string {
 	var (
 		seeds  [][]string
 		length = len(words)
-		min    = int(config.ChainLength)
+		min    = order
 	)
 
 	for i := range words {
@@ -536,59 +783,107 @@ func chainTransliterations(seeds [][]string) [][]string {
 	return transliterations
 }
 
-func generateResponse(input []string, seeds [][]string, triesLeft int) string {
+// generateResponse tries random walks from seeds until there is enough candidates,
+// retrying with artificial seeds. When ctx is done, the best candidate found so far
+// (or a smiley) is returned.
+func generateResponse(ctx context.Context, input []string, seeds [][]string, triesLeft int) string {
+	return explainResponse(ctx, input, seeds, triesLeft, nil)
+}
+
+// explainResponse is generateResponse recording how the response was built in trace (if not nil)
+func explainResponse(ctx context.Context, input []string, seeds [][]string, triesLeft int, trace *explanation) string {
 
 	if config.Debug {
 		log.Println("Generating response for input: " + dump(input))
 	}
 
-	var wg sync.WaitGroup
-	var mtx sync.Mutex
-	var responset = make(uniqueTexts)
-	for _, seed := range append(seeds, chainTransliterations(seeds)...) {
-		wg.Add(1)
-		go func(seed []string) {
-			defer wg.Done()
-			for i := 0; i < int(config.ChainsToTry); i++ {
-				if response := randomBranch(seed); !isEmpty(response) && !contains(seed, response) {
-					mtx.Lock()
+	var (
+		responset    = make(uniqueTexts)
+		recents      = recent.responses(settingsFrom(ctx).Channel)
+		recentTokens = responseTokens(recents)
+		salient      = salientWords(input)
+		last         string
+		origin       = fromInput
+		power        int
+	)
+	if len(recents) > 0 {
+		last = recents[len(recents)-1]
+	}
+	for {
+		allSeeds := append(seeds, chainTransliterations(seeds)...)
+		budget := seedBudget(allSeeds)
+		for i, seed := range allSeeds {
+			if budget[i] == 0 {
+				if config.Debug {
+					log.Println("Skipping seed made of common words only: " + dump(seed))
+				}
+				continue
+			}
+			seedOrigin := origin
+			if i >= len(seeds) {
+				seedOrigin = fromTransliteration
+			}
+			// sequentially, the number of responses generated at once is bounded by Workers
+			for _, walk := range candidateBranches(ctx, seed, budget[i], salient) {
+				steps := strings.Fields(walk)
+				if !pastSeed(steps) {
+					continue // dead end, the walk would just echo the seed
+				}
+				words, filters := postprocessFilters(steps)
+				response := strings.Join(words, " ")
+				if !isEmpty(response) && !contains(seed, response) {
 					responset[response] = struct{}{}
-					mtx.Unlock()
+					trace.walk(response, walkTrace{Seed: seed, Origin: seedOrigin, Power: power, Walk: steps, Filters: filters})
 				}
-				runtime.Gosched()
 			}
-		}(seed)
-	}
-	wg.Wait()
+			if ctx.Err() != nil {
+				break
+			}
+		}
 
-	responses := normalizeResponseChains(responset)
-	count := len(responses)
+		normalized := normalizeResponseChains(responset)
+		trace.medianCutoff(responset, normalized)
+		responses := rejectParroted(ctx, normalized)
+		count := len(responses)
 
-	if config.Debug {
-		log.Println("Found " + fmt.Sprint(len(responses)) + " potential responses")
-		if count > 0 {
-			log.Println(dump(responses))
+		if config.Debug {
+			log.Println("Found " + fmt.Sprint(len(responses)) + " potential responses")
+			if count > 0 {
+				log.Println(dump(responses))
+			}
+		}
+
+		if ctx.Err() != nil {
+			log.Warn("Response generation interrupted (", ctx.Err(), ") with ", count, " potential responses")
+		}
+		if count >= int(config.MinResponsePool) || (count > 0 && ctx.Err() != nil) {
+			candidates := scoreCandidates(avoidRecent(responses, recentTokens), input, recentTokens)
+			response := selectCandidate(candidates)
+			trace.candidates(candidates, response)
+			return detokenize(strings.Split(response.Text, " ")) + " " + smileyAfter(last)
+		}
+		if triesLeft <= 0 || ctx.Err() != nil {
+			return smileyAfter(last)
 		}
-	}
 
-	var response string
-	if count >= int(config.MinResponsePool) {
-		response = responses[rand.Intn(count)]
-		response = response + " " + randomSmiley()
-	} else if triesLeft > 0 {
 		triesLeft--
 		try := int(config.MaxResponseTries) - triesLeft
-		power := try * try * try // * try
+		power = try * try * try // * try
+		origin = fromArtificialSeed
 		if config.Debug {
 			log.Println("Pool of responses is too small, trying again with artificialSeed^" + fmt.Sprint(power))
 		}
-		seeds = artificialSeed(input, power)
-		response = generateResponse(input, seeds, triesLeft)
-	} else {
-		response = randomSmiley()
+		seeds = artificialSeed(ctx, input, power)
 	}
+}
 
-	return response
+func containsOrder(orders []int64, order int64) bool {
+	for _, o := range orders {
+		if o == order {
+			return true
+		}
+	}
+	return false
 }
 
 func contains(items []string, item string) bool {
@@ -600,31 +895,40 @@ func contains(items []string, item string) bool {
 	return false
 }
 
-func randomBranch(words []string) string {
-	chain := words[:config.ChainLength]
+// pastSeed tells if the walk generated any words after the seed chain it started with
+func pastSeed(walk []string) bool {
+	return len(walk) > int(config.ChainLength)
+}
 
-	chainKey := strings.Join(chain, separator)
-	response := []string{chain[0]}
+func randomBranch(ctx context.Context, words []string) string {
+	response := append([]string{}, words[:config.ChainLength]...)
 
-	for i := 0; i < int(config.MaxChainLength); i++ {
-		word := randomWord(chainKey)
-		if !isEmpty(word) {
-			chain = append(chain[1:], word)
-			response = append(response, chain[0])
-			chainKey = strings.Join(chain, separator)
-		} else {
+	for i := 0; i < int(config.MaxChainLength) && ctx.Err() == nil; i++ {
+		word := randomWord(strings.Join(response[len(response)-int(config.ChainLength):], separator))
+		if isEmpty(word) {
 			break
 		}
+		response = append(response, word)
 	}
 
-	response = removeBlacklistedWords(response)
-
 	return strings.Join(response, " ")
 }
 
 func randomWord(key string) string {
+	if cached, ok := followers.get(key); ok {
+		return randomFollower(cached)
+	}
 	corpus := pool.Get()
 	defer corpus.Close()
+	if followers != nil {
+		values, err := redis.Strings(corpus.Do("SMEMBERS", key))
+		if err != nil {
+			redisErr(err)
+			return stop
+		}
+		followers.put(key, values)
+		return randomFollower(values)
+	}
 	value, err := redis.String(corpus.Do("SRANDMEMBER", key))
 	if err == nil || err == redis.ErrNil {
 		return value
@@ -633,14 +937,48 @@ func randomWord(key string) string {
 	return stop
 }
 
+// randomChain returns words of a random chain in the corpus,
+// nil if there is none (or only other data was drawn a few times in a row)
 func randomChain() []string {
 	corpus := pool.Get()
 	defer corpus.Close()
-	value, err := redis.String(corpus.Do("RANDOMKEY"))
+	for i := 0; i < 10; i++ {
+		value, err := redis.String(corpus.Do("RANDOMKEY"))
+		if err != nil {
+			if err != redis.ErrNil {
+				redisErr(err)
+			}
+			return nil
+		}
+		if isChainKey(value) {
+			return strings.Split(value, separator)
+		}
+	}
+	return nil
+}
+
+// isChainKey tells apart chains from other data kept in the corpus
+// (openings, casing, index of lines), which have keys starting with start marker
+func isChainKey(key string) bool {
+	return key != openingsKey && (!strings.HasPrefix(key, start) || strings.HasPrefix(key, start+separator))
+}
+
+// randomOpenings returns up to n distinct chains (of ChainLength) that started sentences in the corpus
+func randomOpenings(n int) [][]string {
+	if config.ChainLength < 2 {
+		return [][]string{{start}}
+	}
+	corpus := pool.Get()
+	defer corpus.Close()
+	values, err := redis.Strings(corpus.Do("SRANDMEMBER", openingsKey, n))
 	if err != nil && err != redis.ErrNil {
 		redisErr(err)
 	}
-	return strings.Split(value, separator)
+	var openings [][]string
+	for _, value := range values {
+		openings = append(openings, append([]string{start}, strings.Split(value, separator)...))
+	}
+	return openings
 }
 
 func purgeCorpus() {
@@ -653,33 +991,98 @@ func purgeCorpus() {
 	}
 }
 
-func artificialSeed(input []string, power int) [][]string {
+// saveCorpus asks Redis to persist corpus to disk in the background (BGSAVE)
+// and waits until it is done (see bgsaveDone), returns exit code for the process
+func saveCorpus() int {
+	log.Info("Saving the Corpus")
+	corpus := pool.Get()
+	defer corpus.Close()
+
+	requested := false
+	deadline := time.Now().Add(time.Duration(config.SaveTimeout) * time.Second)
+	for time.Now().Before(deadline) {
+		info, err := redis.String(corpus.Do("INFO", "persistence"))
+		if err != nil {
+			log.Error("Unable to confirm that Corpus was saved: ", err)
+			return 1
+		}
+		done, err := bgsaveDone(parseInfo(info))
+		if requested && err != nil {
+			log.Error("Unable to save Corpus: ", err)
+			return 1
+		}
+		if requested && done {
+			log.Info("Saved to dump.rdb")
+			return 0
+		}
+		if !requested && done {
+			// a save already in progress could miss the latest lessons, so wait for it and save again
+			_, err := corpus.Do("BGSAVE")
+			if err != nil && !strings.Contains(err.Error(), "already in progress") {
+				log.Error("Unable to save Corpus: ", err)
+				return 1
+			}
+			requested = err == nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	log.Error("Corpus was not saved within " + fmt.Sprint(config.SaveTimeout) + " seconds")
+	return 1
+}
+
+// parseInfo turns reply of INFO into a map of fields
+func parseInfo(info string) map[string]string {
+	fields := make(map[string]string)
+	for _, line := range strings.Split(info, "\n") {
+		if i := strings.Index(line, ":"); i > 0 {
+			fields[line[:i]] = strings.TrimSpace(line[i+1:])
+		}
+	}
+	return fields
+}
+
+// bgsaveDone tells if there is no background save in progress,
+// returns error if the last one failed
+func bgsaveDone(info map[string]string) (bool, error) {
+	if info["rdb_bgsave_in_progress"] != "0" {
+		return false, nil
+	}
+	if status := info["rdb_last_bgsave_status"]; status != "ok" {
+		return true, errors.New("last background save status: " + status)
+	}
+	return true, nil
+}
+
+func artificialSeed(ctx context.Context, input []string, power int) [][]string {
 	var result [][]string
 
 	if isChainEmpty(input) {
-		input = randomChain()[:1]
+		// nothing to build on, start the way real sentences started
+		for _, opening := range randomOpenings(power) {
+			result = append(result, createSeeds(append(opening, stop))...)
+		}
+		if len(result) > 0 || ctx.Err() != nil {
+			return result
+		}
+		chain := randomChain()
+		if len(chain) == 0 {
+			return result
+		}
+		input = chain[:1]
 	}
 
-	var wg sync.WaitGroup
-	var mtx sync.Mutex
+	// sequentially, the number of responses generated at once is bounded by Workers
 	for _, word := range input {
 		if word == stop {
 			break
 		}
-		for i := 0; i < power; i++ {
-			wg.Add(1)
-			go func(word string, i int) {
-				defer wg.Done()
-				for _, mutation := range createSeeds(mutateChain(word, randomChain())) {
-					mtx.Lock()
-					result = append(result, mutation)
-					mtx.Unlock()
-					runtime.Gosched()
-				}
-			}(word, i)
+		if word == start {
+			continue
+		}
+		for i := 0; i < power && ctx.Err() == nil; i++ {
+			result = append(result, createSeeds(mutateChain(word, randomChain()))...)
 		}
 	}
-	wg.Wait()
 
 	/*if config.Debug {
 		log.Println("artificialSeed(", dump(input)+", "+fmt.Sprint(power)+")="+fmt.Sprint(result))
@@ -701,25 +1104,71 @@ func randomSmiley() string {
 	return config.Smileys[rand.Intn(len(config.Smileys))]
 }
 
+// postprocess cleans up words of a response candidate, returns nil if candidate should be rejected
+func postprocess(words []string) []string {
+	words, _ = postprocessFilters(words)
+	return words
+}
+
+// postprocessFilters is postprocess returning names of filters that changed the candidate
+func postprocessFilters(words []string) ([]string, []string) {
+	var filters []string
+	allowed, removed := removeBlacklisted(words)
+	if removed {
+		filters = append(filters, "Blacklist")
+	}
+	ending := removeDanglingEnding(allowed)
+	if len(ending) != len(allowed) {
+		filters = append(filters, "DontEndWith")
+	}
+	balanced, ok := balancePunctuation(ending)
+	if !ok {
+		filters = append(filters, "UnbalancedPunctuation")
+		if config.UnbalancedPunctuation == rejectUnbalanced {
+			return nil, filters
+		}
+	}
+	return balanced, filters
+}
+
 func removeBlacklistedWords(words []string) []string {
+	allowed, _ := removeBlacklisted(words)
+	return removeDanglingEnding(allowed)
+}
+
+// removeBlacklisted removes words listed in Blacklist (and the start marker),
+// returns true if any word was blacklisted
+func removeBlacklisted(words []string) ([]string, bool) {
 	data := make([]string, len(words))
 	end := 0
+	removed := false
 
 Blacklist:
 	for _, word := range words {
+		if word == start {
+			continue // not a word, just marks the beginning of sentence
+		}
 		for _, bad := range config.Blacklist {
 			if word == bad {
+				removed = true
 				continue Blacklist
 			}
 		}
 		data[end] = word
 		end++
 	}
-	words = data[:end]
+	return data[:end], removed
+}
 
+// removeDanglingEnding removes words listed in DontEndWith and dangling punctuation from the end
+func removeDanglingEnding(words []string) []string {
 DontEndWith:
 	for {
 		length := len(words)
+		if length > 0 && isDangling(words[length-1]) {
+			words = words[:length-1]
+			continue
+		}
 		for remove := range config.DontEndWith {
 			if length > 0 && words[length-1] == config.DontEndWith[remove] {
 				words = words[:length-1]
@@ -744,18 +1193,8 @@ func normalizeResponseChains(texts uniqueTexts) []string {
 		log.Println("Normalizing " + fmt.Sprint(len(texts)) + " unique responses")
 	}
 
-	// calculate lengths
-	l := map[int]struct{}{}
-	for text := range texts {
-		l[len(text)] = struct{}{}
-	}
-	lengths := make([]int, 0, len(l))
-	for k := range l {
-		lengths = append(lengths, k)
-	}
-
 	// drop bottom half (below median)
-	threshold := median(lengths)
+	threshold := medianLength(texts)
 	for text := range texts {
 		if len(text) >= threshold {
 			result = append(result, text)
@@ -772,6 +1211,19 @@ func normalizeResponseChains(texts uniqueTexts) []string {
 	return result
 }
 
+// medianLength returns the median of distinct lengths of texts
+func medianLength(texts uniqueTexts) int {
+	l := map[int]struct{}{}
+	for text := range texts {
+		l[len(text)] = struct{}{}
+	}
+	lengths := make([]int, 0, len(l))
+	for k := range l {
+		lengths = append(lengths, k)
+	}
+	return median(lengths)
+}
+
 func median(numbers []int) int {
 	sort.Ints(numbers)
 
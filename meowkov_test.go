@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 )
@@ -18,8 +20,9 @@ func TestMain(m *testing.M) {
 
 func TestProcessInput(t *testing.T) {
 	input := "1 2 3 4 5 6"
-	expWords := []string{"1", "2", "3", "4", "5", "6", stop}
+	expWords := []string{start, "1", "2", "3", "4", "5", "6", stop}
 	expSeeds := [][]string{
+		{start, "1", "2"},
 		{"1", "2", "3"},
 		{"2", "3", "4"},
 		{"3", "4", "5"},
@@ -46,7 +49,7 @@ func TestParseInput(t *testing.T) {
 
 	// plain message
 	input := "1 2 3"
-	expectedWords := []string{"1", "2", "3", stop}
+	expectedWords := []string{start, "1", "2", "3", stop}
 	test(input, expectedWords)
 
 	// remove mentions present at the beginning
@@ -57,19 +60,24 @@ func TestParseInput(t *testing.T) {
 
 	// remove BotName if used as mention at the beginning
 	input = config.BotName + ": look: 2 3"
-	expectedWords = []string{"look:", "2", "3", stop}
+	expectedWords = []string{start, "look", ":", "2", "3", stop}
 	test(input, expectedWords)
 	input = config.BotName + ", look: 2 3"
 	test(input, expectedWords)
 
 	// do not remove BotName if in the middle
 	input = "1 " + config.BotName + " 2 3"
-	expectedWords = []string{"1", config.BotName, "2", "3", stop}
+	expectedWords = []string{start, "1", config.BotName, "2", "3", stop}
 	test(input, expectedWords)
 
 	// lowercase input with exception of URLs
 	input = "PlAy PiAno https://yt.aergia.eu/#v=T0rs3R4E1Sk&t=23;30"
-	expectedWords = []string{"play", "piano", "https://yt.aergia.eu/#v=T0rs3R4E1Sk&t=23;30", stop}
+	expectedWords = []string{start, "play", "piano", "https://yt.aergia.eu/#v=T0rs3R4E1Sk&t=23;30", stop}
+	test(input, expectedWords)
+
+	// keep punctuation as separate tokens, drop IRC formatting
+	input = "\x02Really\x02? (\x0304,01yes\x03)"
+	expectedWords = []string{start, "really", "?", "(", "yes", ")", stop}
 	test(input, expectedWords)
 }
 
@@ -87,37 +95,6 @@ func TestNormalizeWord(t *testing.T) {
 	// strip spaces but no not lowercase URL
 	test("  https://yt.aergia.eu/#v=T0rs3R4E1Sk&t=23;3 ", "https://yt.aergia.eu/#v=T0rs3R4E1Sk&t=23;3")
 
-	// remove " from beginning and/or end
-	test(" \"foo", "foo")
-	test(" foo\" ", "foo")
-	test(" \"foo\" ", "foo")
-	test(" f\"oo ", "f\"oo")
-
-	// remove ' from beginning and/or end
-	test(" 'foo", "foo")
-	test(" foo' ", "foo")
-	test(" 'foo' ", "foo")
-	test(" f'oo ", "f'oo")
-
-	// remove ( and ) from beginning and/or end
-	test(" (foo)", "foo")
-	test(" (foo ", "foo")
-	test(" foo) ", "foo")
-	test(" f(oo ", "f(oo")
-
-	// remove [ and ] from beginning and/or end
-	test(" [foo]", "foo")
-	test(" [foo ", "foo")
-	test(" foo] ", "foo")
-	test(" f[oo ", "f[oo")
-
-	// remove ? and ! from end only
-	test(" foo? ", "foo")
-	test(" foo! ", "foo")
-	test(" foo!?!?!? ", "foo")
-	test(" foo!?bar ", "foo!?bar")
-	test(" “foo” ", "foo")
-	test(" „foo” ", "foo")
 	test(" :-(((((( ", "")
 	test(" :((( ", "")
 	test(" ;[[ ", "")
@@ -147,7 +124,8 @@ func TestIsEmpty(t *testing.T) {
 }
 
 func TestIsChainEmpty(t *testing.T) {
-	problem := !isChainEmpty([]string{stop}) || !isChainEmpty([]string{}) || !isChainEmpty([]string{""})
+	problem := !isChainEmpty([]string{stop}) || !isChainEmpty([]string{}) || !isChainEmpty([]string{""}) ||
+		!isChainEmpty([]string{start, stop}) || isChainEmpty([]string{start, "1", stop})
 	if problem {
 		t.Error("Empty slice should be empty ;-)")
 	}
@@ -171,6 +149,23 @@ func TestCalculateChattiness(t *testing.T) {
 
 }
 
+func TestOwnMentionRegexp(t *testing.T) {
+	aliasesOrig := config.NickAliases
+	config.NickAliases = []string{"kitty"}
+	defer func() { config.NickAliases = aliasesOrig }()
+
+	test := func(message string, nick string, expected bool) {
+		if ownMentionRegexp(nick).MatchString(message) != expected {
+			t.Error("ownMentionRegexp(" + nick + ") should return " + fmt.Sprint(expected) + " for: " + message)
+		}
+	}
+	test("meowkov_: hi", "meowkov_", true)
+	test("hi "+config.BotName, "meowkov_", true)
+	test("KITTY, hi", "meowkov_", true)
+	test("hi there", "meowkov_", false)
+	test("hi there", "", false)
+}
+
 func TestInputSource(t *testing.T) {
 	rawChannelMsg := ":foo!~bar@unaffiliated/foobar PRIVMSG #test :foo"
 	rawPrivateMsg := ":foo!~bar@unaffiliated/foobar PRIVMSG meowkov :foo"
@@ -201,6 +196,41 @@ func TestCreateSeeds(t *testing.T) {
 	}
 }
 
+func TestLearnedSeeds(t *testing.T) {
+	ordersOrig := config.ChainLengths
+	defer func() { config.ChainLengths = ordersOrig }()
+
+	words := []string{"1", "2", "3", stop}
+	seeds := createSeeds(words)
+	config.ChainLengths = []int64{config.ChainLength}
+	if !reflect.DeepEqual(learnedSeeds(words, seeds), seeds) {
+		t.Error("learnedSeeds should return seeds of ChainLength order by default")
+	}
+
+	config.ChainLengths = []int64{3, 2, 1}
+	expected := [][]string{
+		{"1", "2", "3"},
+		{"2", "3", stop},
+		{"1", "2", "3", stop},
+		{"1", "2"},
+		{"2", "3"},
+		{"3", stop},
+	}
+	if output := learnedSeeds(words, seeds); !reflect.DeepEqual(output, expected) {
+		t.Errorf("learnedSeeds should create seeds of every order, got %v", output)
+	}
+}
+
+func TestOpeningSeed(t *testing.T) {
+	opening := openingSeed([]string{start, "1", "2", "3", stop})
+	if !reflect.DeepEqual(opening, []string{openingsKey, "1"}) {
+		t.Errorf("openingSeed should record first words of the sentence, got %q", opening)
+	}
+	if openingSeed([]string{start, stop}) != nil {
+		t.Error("openingSeed should ignore empty sentences")
+	}
+}
+
 func TestAppendTransliterations(t *testing.T) {
 	test := func(input [][]string, expected [][]string) {
 		output := chainTransliterations(input)
@@ -307,9 +337,51 @@ func TestDump(t *testing.T) {
 
 func TestTypingDelay(t *testing.T) {
 	start := time.Now()
-	typingDelay("fooo bar", time.Unix(start.Unix()-1, 0))
+	typingDelay(context.Background(), "fooo bar", time.Unix(start.Unix()-1, 0))
 	end := time.Now()
 	if end.Sub(start) > 1*time.Second {
 		t.Error("typingDelay should occur if response took long time to generate")
 	}
 }
+
+func TestGenerateResponseCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	words, seeds := processInput("1 2 3 4", false)
+	start := time.Now()
+	response := generateResponse(ctx, words, seeds, int(config.MaxResponseTries))
+	if !contains(config.Smileys, response) {
+		t.Error("generateResponse should fall back to a smiley when cancelled, got: " + response)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("generateResponse should stop promptly when cancelled")
+	}
+	if len(artificialSeed(ctx, words, 1000)) != 0 {
+		t.Error("artificialSeed should not generate seeds when cancelled")
+	}
+}
+
+func TestTypingDelayCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	typingDelay(ctx, strings.Repeat("meow ", 1000), start)
+	if time.Since(start) > time.Second {
+		t.Error("typingDelay should be interrupted when context is done")
+	}
+}
+
+func TestBgsaveDone(t *testing.T) {
+	info := parseInfo("# Persistence\r\nloading:0\r\nrdb_bgsave_in_progress:1\r\nrdb_last_bgsave_status:ok\r\n")
+	if done, err := bgsaveDone(info); done || err != nil {
+		t.Error("bgsaveDone should wait for save in progress")
+	}
+	info["rdb_bgsave_in_progress"] = "0"
+	if done, err := bgsaveDone(info); !done || err != nil {
+		t.Error("bgsaveDone should report finished save")
+	}
+	info["rdb_last_bgsave_status"] = "err"
+	if _, err := bgsaveDone(info); err == nil {
+		t.Error("bgsaveDone should report failed save")
+	}
+}
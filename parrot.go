@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+)
+
+// sets of learned lines containing a window of ParrotWindow tokens, can't collide with chains
+const parrotPrefix = start + "line" + separator
+
+// indexLine remembers which windows of tokens appeared in the learned line (markers are skipped)
+func indexLine(words []string) {
+	tokens := withoutMarkers(words)
+	windows := tokenWindows(tokens, int(config.ParrotWindow))
+	if len(windows) == 0 {
+		return
+	}
+	line := hashTokens(tokens)
+
+	corpus := pool.Get()
+	defer corpus.Close()
+	for _, window := range windows {
+		corpus.Send("SADD", parrotPrefix+window, line)
+	}
+	if _, err := corpus.Do(""); err != nil {
+		redisErr(err)
+	}
+}
+
+// rejectParroted removes candidates copying more than MaxCopiedTokens consecutive tokens of a single learned line
+func rejectParroted(ctx context.Context, texts []string) []string {
+	max := int(settingsFrom(ctx).MaxCopiedTokens)
+	if !config.ParrotIndex || max <= 0 || len(texts) == 0 {
+		return texts
+	}
+
+	var windows []string
+	candidates := make([][]string, len(texts))
+	for i, text := range texts {
+		candidates[i] = tokenWindows(strings.Split(text, " "), int(config.ParrotWindow))
+		for _, window := range candidates[i] {
+			if !contains(windows, window) {
+				windows = append(windows, window)
+			}
+		}
+	}
+	lines, err := windowLines(windows)
+	if err != nil {
+		redisErr(err)
+		return texts
+	}
+
+	var result []string
+	for i, text := range texts {
+		found := make([][]string, len(candidates[i]))
+		for j, window := range candidates[i] {
+			found[j] = lines[window]
+		}
+		if copied := longestCopy(found, int(config.ParrotWindow)); copied > max {
+			if config.Debug {
+				log.Println("Rejecting response copying " + fmt.Sprint(copied) + " tokens of a learned line: " + text)
+			}
+			continue
+		}
+		result = append(result, text)
+	}
+	return result
+}
+
+// windowLines returns learned lines containing each window, in one round-trip
+func windowLines(windows []string) (map[string][]string, error) {
+	lines := make(map[string][]string)
+	if len(windows) == 0 {
+		return lines, nil
+	}
+	corpus := pool.Get()
+	defer corpus.Close()
+	for _, window := range windows {
+		corpus.Send("SMEMBERS", parrotPrefix+window)
+	}
+	if err := corpus.Flush(); err != nil {
+		return nil, err
+	}
+	for _, window := range windows {
+		found, err := redis.Strings(corpus.Receive())
+		if err != nil {
+			return nil, err
+		}
+		lines[window] = found
+	}
+	return lines, nil
+}
+
+// longestCopy returns the length of the longest run of tokens copied from a single line,
+// lines[i] are learned lines containing the window starting at i-th token of the candidate
+func longestCopy(lines [][]string, window int) int {
+	var (
+		longest int
+		runs    = make(map[string]int) // consecutive windows ending at the current token, per line
+	)
+	for _, found := range lines {
+		current := make(map[string]int, len(found))
+		for _, line := range found {
+			current[line] = runs[line] + 1
+			if current[line]+window-1 > longest {
+				longest = current[line] + window - 1
+			}
+		}
+		runs = current
+	}
+	return longest
+}
+
+// tokenWindows returns hashes of all windows of size consecutive tokens
+func tokenWindows(tokens []string, size int) []string {
+	var windows []string
+	for i := 0; i+size <= len(tokens); i++ {
+		windows = append(windows, hashTokens(tokens[i:i+size]))
+	}
+	return windows
+}
+
+func hashTokens(tokens []string) string {
+	h := fnv.New64a()
+	h.Write([]byte(strings.Join(tokens, separator)))
+	return fmt.Sprintf("%x", h.Sum64())
+}
+
+func withoutMarkers(words []string) []string {
+	var tokens []string
+	for _, word := range words {
+		if word != start && word != stop {
+			tokens = append(tokens, word)
+		}
+	}
+	return tokens
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestTokenWindows(t *testing.T) {
+	windows := tokenWindows([]string{"a", "b", "c", "d"}, 3)
+	if len(windows) != 2 || windows[0] != hashTokens([]string{"a", "b", "c"}) || windows[1] != hashTokens([]string{"b", "c", "d"}) {
+		t.Errorf("tokenWindows returned unexpected windows: %v", windows)
+	}
+	if len(tokenWindows([]string{"a", "b"}, 3)) != 0 {
+		t.Error("tokenWindows should return nothing for lines shorter than window")
+	}
+	if hashTokens([]string{"ab", "c"}) == hashTokens([]string{"a", "bc"}) {
+		t.Error("hashTokens should respect token boundaries")
+	}
+}
+
+func TestLongestCopy(t *testing.T) {
+	test := func(lines [][]string, expected int) {
+		if copied := longestCopy(lines, 3); copied != expected {
+			t.Errorf("longestCopy(%v) should be %d, got %d", lines, expected, copied)
+		}
+	}
+	test([][]string{{}, {}, {}}, 0)
+	test([][]string{{}, {"x"}, {}}, 3)
+	test([][]string{{"x"}, {"x", "y"}, {"x"}, {}}, 5)
+	// consecutive windows from different lines are not a single copy
+	test([][]string{{"x"}, {"y"}, {"y"}, {"z"}}, 4)
+	test([][]string{{"x", "y"}, {"y"}, {"x"}, {"x"}}, 4)
+	// a copy starting in the middle of a copy from another line
+	test([][]string{{"x"}, {"x", "y"}, {"y"}, {"y"}}, 5)
+	test([][]string{{"x"}, {"x", "y"}, {"x", "y"}, {"y"}, {"x"}}, 5)
+}
+
+func TestWithoutMarkers(t *testing.T) {
+	if tokens := withoutMarkers([]string{start, "a", "b", stop}); !reflect.DeepEqual(tokens, []string{"a", "b"}) {
+		t.Error("withoutMarkers should drop start and stop")
+	}
+}
+
+func TestSettingsFor(t *testing.T) {
+	maxOrig, overridesOrig := config.MaxCopiedTokens, config.ChannelSettings
+	defer func() { config.MaxCopiedTokens, config.ChannelSettings = maxOrig, overridesOrig }()
+
+	strict := int64(5)
+	config.MaxCopiedTokens = 10
+	config.ChannelSettings = map[string]channelSettings{"#cats": {MaxCopiedTokens: &strict}, "#dogs": {}}
+
+	if settingsFor("#Cats").MaxCopiedTokens != 5 {
+		t.Error("channel settings should override global ones (case-insensitive)")
+	}
+	if settingsFor("#dogs").MaxCopiedTokens != 10 || settingsFor("#birds").MaxCopiedTokens != 10 {
+		t.Error("missing channel settings should fall back to global ones")
+	}
+	ctx := withSettings(context.Background(), settingsFor("#cats"))
+	if settingsFrom(ctx).MaxCopiedTokens != 5 || settingsFrom(context.Background()).MaxCopiedTokens != 10 {
+		t.Error("settingsFrom should return settings attached to context")
+	}
+}
+
+func TestIsChainKey(t *testing.T) {
+	for _, key := range []string{"a" + separator + "b", start + separator + "a"} {
+		if !isChainKey(key) {
+			t.Errorf("%q should be a chain key", key)
+		}
+	}
+	for _, key := range []string{openingsKey, casingPrefix + "nasa", parrotPrefix + "1234"} {
+		if isChainKey(key) {
+			t.Errorf("%q should not be a chain key", key)
+		}
+	}
+}
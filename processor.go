@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// size of the queue with messages waiting to be added to the corpus
+const learnQueueSize = 1000
+
+// job is an incoming message that requires a response
+type job struct {
+	t              transport
+	m              message
+	predefined     string // static response, if any
+	prefixWithNick bool
+}
+
+// queues are kept per transport and channel (or private query)
+type queueKey struct {
+	t      transport
+	source string
+}
+
+// processor is a bounded pool of workers generating responses.
+// Every channel has its own short queue (oldest messages are dropped when it is full)
+// and workers take jobs from channels in round-robin fashion.
+// Learning has a separate queue, so it never waits for response generation.
+type processor struct {
+	ctx     context.Context // cancelled on shutdown
+	cancel  context.CancelFunc
+	mtx     sync.Mutex
+	cond    *sync.Cond
+	queues  map[queueKey][]job
+	order   []queueKey // channels with pending jobs
+	closed  bool
+	workers sync.WaitGroup
+	replies sync.WaitGroup
+
+	learn   chan string
+	learner sync.WaitGroup
+	drained sync.Once
+
+	droppedJobs    int64
+	droppedLessons int64
+}
+
+func newProcessor(workers int) *processor {
+	p := &processor{
+		queues: make(map[queueKey][]job),
+		learn:  make(chan string, learnQueueSize),
+	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	p.cond = sync.NewCond(&p.mtx)
+
+	p.learner.Add(1)
+	go func() {
+		defer p.learner.Done()
+		for text := range p.learn {
+			processInput(text, true)
+		}
+	}()
+
+	for i := 0; i < workers; i++ {
+		p.workers.Add(1)
+		go func() {
+			defer p.workers.Done()
+			for {
+				j, ok := p.next()
+				if !ok {
+					return
+				}
+				p.process(j)
+			}
+		}()
+	}
+	return p
+}
+
+// dispatch decides if the bot should react to the incoming message
+// and queues learning and response generation
+func (p *processor) dispatch(t transport, m message) {
+	input := strings.TrimSpace(m.text)
+	predefined := predefinedResponse(input)
+
+	if m.learn && predefined == "" {
+		p.addLesson(input)
+	}
+
+	if predefined != "" {
+		history.add(m.source, m.nick, input, m.receivedAt)
+		bumpLastReaction()
+		p.enqueue(job{t: t, m: m, predefined: predefined, prefixWithNick: !m.private})
+		return
+	}
+
+	chattiness := calculateChattiness(input, t.nick(), m.private)
+	if chattiness < config.ThreadChattiness && history.inThread(m.source, m.nick, m.receivedAt) {
+		chattiness = config.ThreadChattiness
+	}
+	history.add(m.source, m.nick, input, m.receivedAt)
+	if react(chattiness) {
+		bumpLastReaction()
+		p.enqueue(job{t: t, m: m, prefixWithNick: chattiness == always && !m.private})
+	}
+}
+
+func (p *processor) addLesson(text string) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.closed {
+		return
+	}
+	select {
+	case p.learn <- text:
+	default:
+		atomic.AddInt64(&p.droppedLessons, 1)
+		log.Warn("Learning queue is full, message will not be added to the corpus")
+	}
+}
+
+func (p *processor) enqueue(j job) {
+	key := queueKey{j.t, j.m.source}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.closed {
+		return
+	}
+	queue := p.queues[key]
+	if len(queue) == 0 {
+		p.order = append(p.order, key)
+	}
+	if limit := int(config.MaxQueuedPerChannel); len(queue) >= limit {
+		dropped := len(queue) - limit + 1
+		atomic.AddInt64(&p.droppedJobs, int64(dropped))
+		log.Warn("Too many messages waiting for response in " + j.m.source + ", dropping " + fmt.Sprint(dropped) + " oldest")
+		queue = queue[dropped:]
+	}
+	p.queues[key] = append(queue, j)
+	p.cond.Signal()
+}
+
+// next blocks until there is a job to process, returns false when processor is drained
+func (p *processor) next() (job, bool) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for len(p.order) == 0 && !p.closed {
+		p.cond.Wait()
+	}
+	if len(p.order) == 0 {
+		return job{}, false
+	}
+
+	key := p.order[0]
+	p.order = p.order[1:]
+	queue := p.queues[key]
+	j := queue[0]
+	if len(queue) > 1 {
+		p.queues[key] = queue[1:]
+		p.order = append(p.order, key)
+	} else {
+		delete(p.queues, key)
+	}
+	return j, true
+}
+
+func (p *processor) process(j job) {
+	if age := time.Since(j.m.receivedAt); age > time.Duration(config.MaxMessageAge)*time.Second {
+		atomic.AddInt64(&p.droppedJobs, 1)
+		log.Warn("Dropping stale message from " + j.m.source + " received " + fmt.Sprint(age) + " ago")
+		return
+	}
+
+	response := j.predefined
+	if response == "" {
+		ctx, cancel := context.WithTimeout(withSettings(p.ctx, settingsFor(j.m.source)), time.Duration(config.GenerationTimeout)*time.Millisecond)
+		words, seeds := processInput(strings.TrimSpace(j.m.text), false)
+		words, seeds = withContext(j.m.source, j.m.receivedAt, words, seeds)
+		var trace *explanation
+		if !j.m.private {
+			// private queries are not exposed via /explain?last=1
+			trace = &explanation{Message: j.m.text, Channel: j.m.source, Time: j.m.receivedAt, Input: words}
+		}
+		response = explainResponse(ctx, words, seeds, int(config.MaxResponseTries), trace)
+		cancel()
+		if trace != nil {
+			trace.Response = response
+			explanations.remember(trace)
+		}
+		recent.remember(j.m.source, response, j.m.private)
+	}
+
+	history.replied(j.m.source, j.t.nick(), j.m.nick, response, time.Now())
+
+	// typing delay should not keep the worker busy
+	p.replies.Add(1)
+	go func() {
+		defer p.replies.Done()
+		reply(p.ctx, j.t, j.m, response, j.prefixWithNick)
+	}()
+}
+
+// stop interrupts response generation and typing delays in progress
+func (p *processor) stop() {
+	p.cancel()
+}
+
+// shutdown drains the processor, interrupting responses that take longer than timeout
+func (p *processor) shutdown(timeout time.Duration) {
+	drained := make(chan struct{})
+	go func() {
+		p.drain()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(timeout):
+		log.Warn("Pending responses did not finish in " + fmt.Sprint(timeout) + ", cancelling them")
+		p.stop()
+		<-drained
+	}
+	log.Info("Message processing finished")
+}
+
+// drain stops accepting new messages and waits until queued ones are processed
+// and queued learning is flushed to the corpus
+func (p *processor) drain() {
+	p.mtx.Lock()
+	p.closed = true
+	p.cond.Broadcast()
+	p.mtx.Unlock()
+
+	p.workers.Wait()
+	p.replies.Wait()
+	p.drained.Do(func() {
+		close(p.learn)
+	})
+	p.learner.Wait()
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// recordingTransport remembers everything that was sent
+type recordingTransport struct {
+	mtx  sync.Mutex
+	sent []string
+}
+
+func (t *recordingTransport) run(handle func(message)) error { return nil }
+func (t *recordingTransport) nick() string                   { return config.BotName }
+func (t *recordingTransport) close()                         {}
+func (t *recordingTransport) message(target string, text string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.sent = append(t.sent, target+" "+text)
+}
+func (t *recordingTransport) action(target string, text string) {
+	t.message(target, "/me "+text)
+}
+
+func TestProcessorQueues(t *testing.T) {
+	limitOrig := config.MaxQueuedPerChannel
+	config.MaxQueuedPerChannel = 2
+	defer func() { config.MaxQueuedPerChannel = limitOrig }()
+
+	tr := &recordingTransport{}
+	p := newProcessor(0) // no workers, jobs are taken manually
+	add := func(source string, text string) {
+		p.enqueue(job{t: tr, m: message{source: source, text: text}})
+	}
+	add("#a", "a1")
+	add("#a", "a2")
+	add("#a", "a3") // drops a1
+	add("#b", "b1")
+
+	var order []string
+	for len(p.order) > 0 {
+		j, _ := p.next()
+		order = append(order, j.m.text)
+	}
+	expected := []string{"a2", "b1", "a3"}
+	if dump(order) != dump(expected) {
+		t.Error("processor should drop oldest jobs and serve channels round-robin, expected " + dump(expected) + " but got " + dump(order))
+	}
+	if p.droppedJobs != 1 {
+		t.Error("processor should count dropped jobs")
+	}
+}
+
+func TestProcessorDropsStaleMessages(t *testing.T) {
+	tr := &recordingTransport{}
+	p := newProcessor(2)
+	stale := time.Now().Add(-time.Duration(config.MaxMessageAge+1) * time.Second)
+	p.enqueue(job{t: tr, m: message{source: "#a", receivedAt: stale}, predefined: "too late"})
+	p.enqueue(job{t: tr, m: message{source: "#b", receivedAt: time.Now()}, predefined: "just in time"})
+	p.drain()
+
+	if len(tr.sent) != 1 || tr.sent[0] != "#b just in time" {
+		t.Errorf("processor should respond only to fresh messages, sent: %v", tr.sent)
+	}
+	// nothing is accepted after drain
+	p.dispatch(tr, message{source: "#a", text: "are you a bot", receivedAt: time.Now()})
+	if len(p.order) != 0 {
+		t.Error("drained processor should not accept new jobs")
+	}
+}
+
+func TestProcessorShutdown(t *testing.T) {
+	tr := &recordingTransport{}
+	p := newProcessor(1)
+	// typing this would take a few minutes
+	long := strings.Repeat("meow ", 1000)
+	p.enqueue(job{t: tr, m: message{source: "#a", receivedAt: time.Now()}, predefined: long})
+
+	start := time.Now()
+	p.shutdown(50 * time.Millisecond)
+	if time.Since(start) > time.Second {
+		t.Error("processor.shutdown should cancel typing delays after timeout")
+	}
+	if len(tr.sent) != 1 {
+		t.Error("processor.shutdown should still send pending responses")
+	}
+	p.drain() // safe to call again
+}
+
+func TestProcessorForgetsPrivateQueries(t *testing.T) {
+	tr := &recordingTransport{}
+	p := newProcessor(1)
+	p.enqueue(job{t: tr, m: message{source: "alice", text: "my password is meow", private: true, receivedAt: time.Now()}})
+	p.enqueue(job{t: tr, m: message{source: "#private", text: "meow", receivedAt: time.Now()}})
+	p.drain()
+
+	if explanations.last("alice") != nil {
+		t.Error("explanations of responses to private queries should not be remembered")
+	}
+	if explanations.last("#private") == nil {
+		t.Error("explanations of responses in channels should be remembered")
+	}
+}
+
+// blockingTransport stays connected until closed, logging events in order
+type blockingTransport struct {
+	recordingTransport
+	closed chan struct{}
+	events *[]string
+}
+
+func (t *blockingTransport) run(handle func(message)) error {
+	handle(message{source: "#a", text: "are you a bot", receivedAt: time.Now()})
+	<-t.closed
+	return nil
+}
+
+func (t *blockingTransport) message(target string, text string) {
+	t.recordingTransport.message(target, text)
+	*t.events = append(*t.events, "message")
+}
+
+func (t *blockingTransport) close() {
+	*t.events = append(*t.events, "close")
+	close(t.closed)
+}
+
+func TestRunChatShutdownOrder(t *testing.T) {
+	timeoutOrig := config.ShutdownTimeout
+	config.ShutdownTimeout = 0
+	defer func() { config.ShutdownTimeout = timeoutOrig }()
+
+	var events []string
+	tr := &blockingTransport{closed: make(chan struct{}), events: &events}
+	signals := make(chan os.Signal, 2)
+	go func() {
+		time.Sleep(10 * time.Millisecond) // let the transport pass a message first
+		signals <- syscall.SIGTERM
+	}()
+
+	exitCode, stopped := runChat(newProcessor(1), []transport{tr}, signals, func() int {
+		events = append(events, "save")
+		return 0
+	})
+	if !stopped || exitCode != 0 {
+		t.Errorf("runChat should shut down on signal, returned %d %v", exitCode, stopped)
+	}
+	expected := []string{"message", "close", "save"}
+	if dump(events) != dump(expected) {
+		t.Error("shutdown should respond, then disconnect, then save the corpus before returning, expected " + dump(expected) + " but got " + dump(events))
+	}
+}
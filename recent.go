@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// recentResponses remembers the last responses in every channel,
+// so the bot does not repeat itself (see noveltyScore and avoidRecent)
+type recentResponses struct {
+	mtx      sync.Mutex
+	size     int
+	path     string // file to persist responses in, if not empty
+	channels map[string][]string
+	private  map[string]bool // private queries, their responses are not persisted
+}
+
+var recent *recentResponses
+
+// newRecentResponses loads responses persisted by previous run from path (if not empty)
+func newRecentResponses(size int, path string) *recentResponses {
+	r := &recentResponses{size: size, path: path, channels: make(map[string][]string), private: make(map[string]bool)}
+	if path == "" {
+		return r
+	}
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, &r.channels)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Warn("Unable to load recent responses from "+path+": ", err)
+	}
+	for channel, responses := range r.channels {
+		if len(responses) > size {
+			r.channels[channel] = responses[len(responses)-size:]
+		}
+	}
+	return r
+}
+
+// remember adds response to the ring of the channel, dropping the oldest one,
+// responses to private queries are kept in memory only
+func (r *recentResponses) remember(channel string, response string, private bool) {
+	if r == nil {
+		return
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	channel = strings.ToLower(channel)
+	responses := append(r.channels[channel], response)
+	if len(responses) > r.size {
+		responses = responses[len(responses)-r.size:]
+	}
+	r.channels[channel] = responses
+	if private {
+		r.private[channel] = true
+		return
+	}
+	if r.path != "" {
+		if err := r.save(); err != nil {
+			log.Warn("Unable to save recent responses to "+r.path+": ", err)
+		}
+	}
+}
+
+// responses returns recent responses in the channel, from the oldest one
+func (r *recentResponses) responses(channel string) []string {
+	if r == nil {
+		return nil
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return append([]string{}, r.channels[strings.ToLower(channel)]...)
+}
+
+func (r *recentResponses) save() error {
+	public := make(map[string][]string, len(r.channels))
+	for channel, responses := range r.channels {
+		if !r.private[channel] {
+			public[channel] = responses
+		}
+	}
+	data, err := json.Marshal(public)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(r.path), filepath.Base(r.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), r.path)
+}
+
+// responseTokens returns normalized words of responses, as they would be learned
+func responseTokens(responses []string) [][]string {
+	tokens := make([][]string, len(responses))
+	for i, response := range responses {
+		tokens[i] = withoutMarkers(parseInput(response))
+	}
+	return tokens
+}
+
+// similarity of token sets (Jaccard index): 1 for the same words, 0 for no common words
+func similarity(a []string, b []string) float64 {
+	setA, setB := make(map[string]bool), make(map[string]bool)
+	for _, token := range a {
+		setA[token] = true
+	}
+	for _, token := range b {
+		setB[token] = true
+	}
+	common := 0
+	for token := range setB {
+		if setA[token] {
+			common++
+		}
+	}
+	union := len(setA) + len(setB) - common
+	if union == 0 {
+		return 1
+	}
+	return float64(common) / float64(union)
+}
+
+// avoidRecent removes candidates too similar to recent responses (RecentSimilarity),
+// unless it would remove all of them (then noveltyScore picks the least similar), RecentSimilarity 0 keeps all
+func avoidRecent(texts []string, recentTokens [][]string) []string {
+	if len(recentTokens) == 0 || config.RecentSimilarity <= 0 {
+		return texts
+	}
+	var result []string
+	for _, text := range texts {
+		if maxSimilarity(strings.Split(text, " "), recentTokens) < config.RecentSimilarity {
+			result = append(result, text)
+		}
+	}
+	if len(result) == 0 {
+		return texts
+	}
+	return result
+}
+
+func maxSimilarity(tokens []string, recentTokens [][]string) float64 {
+	max := 0.0
+	for _, r := range recentTokens {
+		if s := similarity(tokens, r); s > max {
+			max = s
+		}
+	}
+	return max
+}
+
+// smileyAfter picks random smiley different from the one ending the last response (if possible)
+func smileyAfter(last string) string {
+	var smileys []string
+	for _, smiley := range config.Smileys {
+		if last != smiley && !strings.HasSuffix(last, " "+smiley) {
+			smileys = append(smileys, smiley)
+		}
+	}
+	if len(smileys) == 0 {
+		return randomSmiley()
+	}
+	return smileys[rand.Intn(len(smileys))]
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRecentResponses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meowkov-recent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "recent.json")
+
+	r := newRecentResponses(2, path)
+	r.remember("#Cats", "one", false)
+	r.remember("#cats", "two", false)
+	r.remember("#cats", "three", false)
+	r.remember("alice", "psst", true)
+	r.remember("#dogs", "woof", false) // saves all channels
+	if responses := r.responses("alice"); !reflect.DeepEqual(responses, []string{"psst"}) {
+		t.Errorf("responses to private queries should be remembered in memory, got %v", responses)
+	}
+	if responses := r.responses("#cats"); !reflect.DeepEqual(responses, []string{"two", "three"}) {
+		t.Errorf("recent responses should keep the last 2 per channel, got %v", responses)
+	}
+
+	restored := newRecentResponses(1, path)
+	if responses := restored.responses("#cats"); !reflect.DeepEqual(responses, []string{"three"}) {
+		t.Errorf("recent responses should be restored from file, got %v", responses)
+	}
+	if responses := restored.responses("alice"); len(responses) != 0 {
+		t.Errorf("responses to private queries should not be persisted, got %v", responses)
+	}
+
+	var disabled *recentResponses
+	disabled.remember("#cats", "meow", false)
+	if disabled.responses("#cats") != nil {
+		t.Error("nil recentResponses should not remember anything")
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	test := func(a []string, b []string, expected float64) {
+		if s := similarity(a, b); s != expected {
+			t.Errorf("similarity(%v, %v) should be %v, got %v", a, b, expected, s)
+		}
+	}
+	test([]string{"a", "b"}, []string{"b", "a"}, 1)
+	test([]string{"a", "b"}, []string{"c"}, 0)
+	test([]string{"a", "b", "c"}, []string{"a", "b", "d"}, 0.5)
+	test([]string{}, []string{"x", "x"}, 0)
+	test(nil, nil, 1)
+}
+
+func TestAvoidRecent(t *testing.T) {
+	recentTokens := responseTokens([]string{"I like cats :-<"})
+	if !reflect.DeepEqual(recentTokens, [][]string{{"i", "like", "cats"}}) {
+		t.Errorf("responseTokens should return normalized words without smileys, got %v", recentTokens)
+	}
+	texts := []string{"i like cats", "cats like i", "i like dogs"}
+	if output := avoidRecent(texts, recentTokens); !reflect.DeepEqual(output, []string{"i like dogs"}) {
+		t.Errorf("avoidRecent should remove repeated responses, got %v", output)
+	}
+	if output := avoidRecent(texts[:1], recentTokens); len(output) != 1 {
+		t.Error("avoidRecent should not remove all candidates")
+	}
+
+	similarityOrig := config.RecentSimilarity
+	defer func() { config.RecentSimilarity = similarityOrig }()
+	config.RecentSimilarity = 0
+	if output := avoidRecent(texts, recentTokens); !reflect.DeepEqual(output, texts) {
+		t.Errorf("avoidRecent should keep all candidates when RecentSimilarity is 0, got %v", output)
+	}
+}
+
+func TestSmileyAfter(t *testing.T) {
+	smileysOrig := config.Smileys
+	defer func() { config.Smileys = smileysOrig }()
+
+	config.Smileys = []string{":<", ":>"}
+	for i := 0; i < 10; i++ {
+		if smileyAfter("meow :<") != ":>" || smileyAfter(":>") != ":<" {
+			t.Error("smileyAfter should not repeat the last smiley")
+		}
+	}
+	config.Smileys = []string{":<"}
+	if smileyAfter(":<") != ":<" {
+		t.Error("smileyAfter should repeat the only smiley")
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+)
+
+// newRedisPool creates connection pool for the corpus
+func newRedisPool() *redis.Pool {
+	if len(config.RedisSentinels) > 0 {
+		log.Println("Connecting to Redis master '" + config.RedisSentinelMaster + "' via Sentinels at " + strings.Join(config.RedisSentinels, ", "))
+	} else {
+		_, address := redisAddress()
+		log.Println("Connecting to Redis at " + address)
+	}
+
+	tlsConfig, err := redisTLSConfig()
+	check(err, "Unable to configure TLS for Redis: ")
+
+	return &redis.Pool{
+		MaxIdle:     int(config.RedisMaxIdle),
+		MaxActive:   int(config.RedisMaxActive),
+		Wait:        true,
+		IdleTimeout: time.Duration(config.RedisIdleTimeout) * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return dialRedis(tlsConfig)
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			// ping connections that were idle more than a minute
+			if time.Since(t) < time.Minute {
+				return nil
+			}
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+}
+
+func dialRedis(tlsConfig *tls.Config) (redis.Conn, error) {
+	var network, address string
+	if len(config.RedisSentinels) > 0 {
+		master, err := sentinelMaster()
+		if err != nil {
+			return nil, err
+		}
+		network, address = "tcp", master
+	} else {
+		network, address = redisAddress()
+	}
+
+	options := redisDialOptions()
+	if tlsConfig != nil && network == "tcp" {
+		options = append(options, redis.DialUseTLS(true), redis.DialTLSConfig(tlsConfig))
+	}
+	c, err := redis.Dial(network, address, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.RedisPassword != "" {
+		args := []interface{}{config.RedisPassword}
+		if config.RedisUser != "" {
+			args = []interface{}{config.RedisUser, config.RedisPassword} // Redis 6 ACL
+		}
+		if _, err := c.Do("AUTH", args...); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if config.RedisDatabase != 0 {
+		if _, err := c.Do("SELECT", config.RedisDatabase); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	if len(config.RedisSentinels) > 0 {
+		// make sure Sentinel did not point us to a replica during failover
+		role, err := redis.Values(c.Do("ROLE"))
+		if err == nil && (len(role) == 0 || fmt.Sprintf("%s", role[0]) != "master") {
+			err = errors.New("Redis at " + address + " is not a master")
+		}
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func redisDialOptions() []redis.DialOption {
+	return []redis.DialOption{
+		redis.DialConnectTimeout(time.Duration(config.RedisConnectTimeout) * time.Millisecond),
+		redis.DialReadTimeout(time.Duration(config.RedisReadTimeout) * time.Millisecond),
+		redis.DialWriteTimeout(time.Duration(config.RedisWriteTimeout) * time.Millisecond),
+	}
+}
+
+// sentinelMaster asks Sentinels (in order) for the address of the current master
+func sentinelMaster() (string, error) {
+	var lastErr error
+	for _, sentinel := range config.RedisSentinels {
+		c, err := redis.Dial("tcp", sentinel, redisDialOptions()...)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if config.RedisSentinelPassword != "" {
+			if _, err = c.Do("AUTH", config.RedisSentinelPassword); err != nil {
+				c.Close()
+				lastErr = err
+				continue
+			}
+		}
+		master, err := redis.Strings(c.Do("SENTINEL", "get-master-addr-by-name", config.RedisSentinelMaster))
+		c.Close()
+		if err == nil && len(master) == 2 {
+			return net.JoinHostPort(master[0], master[1]), nil
+		}
+		if err == nil || err == redis.ErrNil {
+			err = errors.New("Sentinel " + sentinel + " does not know master '" + config.RedisSentinelMaster + "'")
+		}
+		lastErr = err
+	}
+	return "", lastErr
+}
+
+// redisAddress returns network and address of Redis,
+// RedisServer can be "host:port", "unix:///path/to/redis.sock" or "/path/to/redis.sock"
+func redisAddress() (string, string) {
+	if strings.HasPrefix(config.RedisServer, "unix://") {
+		return "unix", strings.TrimPrefix(config.RedisServer, "unix://")
+	}
+	if strings.HasPrefix(config.RedisServer, "/") {
+		return "unix", config.RedisServer
+	}
+	return "tcp", getRedisServer()
+}
+
+// redisTLSConfig returns nil if TLS is disabled
+func redisTLSConfig() (*tls.Config, error) {
+	if !config.RedisTLS {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.RedisTLSSkipVerify}
+	if config.RedisTLSCA != "" {
+		pem, err := ioutil.ReadFile(config.RedisTLSCA)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + config.RedisTLSCA)
+		}
+		tlsConfig.RootCAs = roots
+	}
+	return tlsConfig, nil
+}
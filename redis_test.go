@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestRedisAddress(t *testing.T) {
+	orig := config.RedisServer
+	defer func() { config.RedisServer = orig }()
+
+	test := func(server string, expectedNetwork string, expectedAddress string) {
+		config.RedisServer = server
+		network, address := redisAddress()
+		if network != expectedNetwork || address != expectedAddress {
+			t.Error("redisAddress(" + server + ") should return " + expectedNetwork + " " + expectedAddress + " but got " + network + " " + address)
+		}
+	}
+	test("localhost:6379", "tcp", "localhost:6379")
+	test("/var/run/redis.sock", "unix", "/var/run/redis.sock")
+	test("unix:///var/run/redis.sock", "unix", "/var/run/redis.sock")
+}
+
+func TestRedisTLSConfig(t *testing.T) {
+	tlsOrig, caOrig := config.RedisTLS, config.RedisTLSCA
+	defer func() { config.RedisTLS, config.RedisTLSCA = tlsOrig, caOrig }()
+
+	config.RedisTLS = false
+	if c, err := redisTLSConfig(); c != nil || err != nil {
+		t.Error("redisTLSConfig should return nil when TLS is disabled")
+	}
+
+	config.RedisTLS = true
+	config.RedisTLSCA = ""
+	if c, err := redisTLSConfig(); c == nil || err != nil || c.RootCAs != nil {
+		t.Error("redisTLSConfig should use system CAs by default")
+	}
+
+	ca, _ := ioutil.TempFile("", "meowkov-ca")
+	defer os.Remove(ca.Name())
+	ca.WriteString("not a certificate")
+	ca.Close()
+	config.RedisTLSCA = ca.Name()
+	if _, err := redisTLSConfig(); err == nil {
+		t.Error("redisTLSConfig should fail when CA file has no certificates")
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+)
+
+// hash with counts of followers of a chain (the set of followers is kept as well,
+// for older corpora and uniform walks), can't collide with chains
+const countsPrefix = start + "n" + separator
+
+// samplingWalkScript is backoffWalkScript picking followers by their frequency (see sampleFollower),
+// ARGV = countsPrefix, max length, number of walks, separator, stop, Temperature, TopK, TopP,
+// number of words to generate before stop is allowed, MinFollowers, random seed,
+// number of orders, orders..., seed words...
+var samplingWalkScript = redis.NewScript(0, `
+local prefix = ARGV[1]
+local maxLength = tonumber(ARGV[2])
+local walks = tonumber(ARGV[3])
+local separator = ARGV[4]
+local stop = ARGV[5]
+local temperature = tonumber(ARGV[6])
+local topK = tonumber(ARGV[7])
+local topP = tonumber(ARGV[8])
+local minWords = tonumber(ARGV[9])
+local minFollowers = tonumber(ARGV[10])
+math.randomseed(tonumber(ARGV[11]))
+local orderCount = tonumber(ARGV[12])
+local orders = {}
+for i = 1, orderCount do
+	orders[i] = tonumber(ARGV[12 + i])
+end
+
+-- followers of the chain with their counts, followers learned before counting have count 1
+local function followers(key)
+	local members = redis.call('SMEMBERS', key)
+	local counts = {}
+	for _, member in ipairs(members) do
+		counts[member] = 1
+	end
+	local hash = redis.call('HGETALL', prefix .. key)
+	for i = 1, #hash, 2 do
+		if counts[hash[i]] then
+			counts[hash[i]] = tonumber(hash[i + 1])
+		end
+	end
+	local list = {}
+	for word, count in pairs(counts) do
+		list[#list + 1] = {word, count}
+	end
+	return list
+end
+
+local function sample(list, canStop)
+	local candidates = {}
+	for _, follower in ipairs(list) do
+		if canStop or follower[1] ~= stop or #list == 1 then
+			candidates[#candidates + 1] = follower
+		end
+	end
+	if #candidates == 0 then
+		return nil
+	end
+	table.sort(candidates, function(a, b)
+		if a[2] ~= b[2] then
+			return a[2] > b[2]
+		end
+		return a[1] < b[1]
+	end)
+	if temperature <= 0 then
+		return candidates[1][1]
+	end
+	if topK > 0 then
+		for i = #candidates, topK + 1, -1 do
+			candidates[i] = nil
+		end
+	end
+	local total = 0
+	for _, c in ipairs(candidates) do
+		c[3] = (c[2] / candidates[1][2]) ^ (1 / temperature)
+		total = total + c[3]
+	end
+	if topP > 0 and topP < 1 then
+		local sum, kept = 0, 0
+		for i, c in ipairs(candidates) do
+			sum, kept = sum + c[3], i
+			if sum >= topP * total then
+				break
+			end
+		end
+		for i = #candidates, kept + 1, -1 do
+			candidates[i] = nil
+		end
+		total = sum
+	end
+	local r = math.random() * total
+	for _, c in ipairs(candidates) do
+		if r < c[3] then
+			return c[1]
+		end
+		r = r - c[3]
+	end
+	return candidates[#candidates][1]
+end
+
+local results = {}
+for w = 1, walks do
+	local response = {}
+	for i = 13 + orderCount, #ARGV do
+		response[#response + 1] = ARGV[i]
+	end
+	for i = 1, maxLength do
+		local list, fallback = nil, nil
+		for _, order in ipairs(orders) do
+			if order <= #response then
+				local found = followers(table.concat(response, separator, #response - order + 1, #response))
+				if #found >= minFollowers then
+					list = found
+					break
+				elseif #found > 0 and not fallback then
+					fallback = found
+				end
+			end
+		end
+		list = list or fallback
+		if not list then
+			break
+		end
+		local word = sample(list, i > minWords)
+		if not word or word == '' or word == stop then
+			break
+		end
+		response[#response + 1] = word
+	end
+	results[w] = table.concat(response, separator)
+end
+return results
+`)
+
+// countsFollowers tells if storeSeeds should count followers,
+// their frequencies are used by sampling (globally or in any channel) and beam search
+func countsFollowers() bool {
+	return config.GenerationMode == beamGeneration || samplingEnabled()
+}
+
+// samplingBranches returns up to n walks starting at the chain of words, sampling followers
+// with Temperature, TopK, TopP and MinLength from settings (when Sampling is enabled)
+func samplingBranches(ctx context.Context, words []string, n int, s settings) []string {
+	if config.WalkMode == serverWalk {
+		branches, err := serverSamplingBranches(words, n, s)
+		if err == nil {
+			return branches
+		}
+		redisErr(err)
+		if config.Debug {
+			log.Println("Server-side walk failed, falling back to client-side walk")
+		}
+	}
+
+	var branches []string
+	for i := 0; i < n && ctx.Err() == nil; i++ {
+		branches = append(branches, samplingBranch(ctx, words, s))
+	}
+	return branches
+}
+
+func serverSamplingBranches(words []string, n int, s settings) ([]string, error) {
+	corpus := pool.Get()
+	defer corpus.Close()
+
+	chain := words[:config.ChainLength]
+	args := redis.Args{}.Add(countsPrefix, config.MaxChainLength, n, separator, stop,
+		s.Temperature, s.TopK, s.TopP, minWords(chain, s), config.MinFollowers, rand.Int31(), len(config.ChainLengths))
+	for _, order := range config.ChainLengths {
+		args = args.Add(order)
+	}
+	for _, word := range chain {
+		args = args.Add(word)
+	}
+	walks, err := redis.Strings(samplingWalkScript.Do(corpus, args...))
+	if err != nil {
+		return nil, err
+	}
+
+	branches := make([]string, 0, len(walks))
+	for _, walk := range walks {
+		branches = append(branches, strings.Join(strings.Split(walk, separator), " "))
+	}
+	return branches, nil
+}
+
+// samplingBranch is backoffBranch picking followers by their frequency
+func samplingBranch(ctx context.Context, words []string, s settings) string {
+	corpus := pool.Get()
+	defer corpus.Close()
+
+	response := append([]string{}, words[:config.ChainLength]...)
+	wordsLeft := minWords(response, s)
+	for i := 0; i < int(config.MaxChainLength) && ctx.Err() == nil; i++ {
+		frequencies, err := backoffFollowers(corpus, response)
+		if err != nil {
+			redisErr(err)
+			break
+		}
+		word := sampleFollower(frequencies, int64(i) >= wordsLeft, s, rand.Float64())
+		if isEmpty(word) {
+			break
+		}
+		response = append(response, word)
+	}
+	return strings.Join(response, " ")
+}
+
+// minWords returns the number of words to generate after the chain before stop is allowed
+func minWords(chain []string, s settings) int64 {
+	if left := s.MinLength - int64(len(withoutMarkers(chain))); left > 0 {
+		return left
+	}
+	return 0
+}
+
+// backoffFollowers returns followers with their counts of the longest chain (last words of history)
+// having at least MinFollowers followers, or of the longest chain having any, in one round-trip
+func backoffFollowers(corpus redis.Conn, history []string) (map[string]int, error) {
+	orders := sendFollowers(corpus, history)
+	if err := corpus.Flush(); err != nil {
+		return nil, err
+	}
+	return receiveFollowers(corpus, orders)
+}
+
+// sendFollowers queues requests for followers of chains of every order (last words of history),
+// returns the number of orders
+func sendFollowers(corpus redis.Conn, history []string) int {
+	var orders int
+	for _, order := range config.ChainLengths {
+		if int(order) <= len(history) {
+			key := strings.Join(history[len(history)-int(order):], separator)
+			corpus.Send("SMEMBERS", key)
+			corpus.Send("HGETALL", countsPrefix+key)
+			orders++
+		}
+	}
+	return orders
+}
+
+// receiveFollowers reads replies to sendFollowers and backs off like backoffFollowers
+func receiveFollowers(corpus redis.Conn, orders int) (map[string]int, error) {
+	var found, fallback map[string]int
+	for i := 0; i < orders; i++ {
+		members, err := redis.Strings(corpus.Receive())
+		if err != nil {
+			return nil, err
+		}
+		counts, err := redis.IntMap(corpus.Receive())
+		if err != nil {
+			return nil, err
+		}
+		if found != nil {
+			continue // replies have to be received anyway
+		}
+		if int64(len(members)) >= config.MinFollowers {
+			found = followerFrequencies(members, counts)
+		} else if len(members) > 0 && fallback == nil {
+			fallback = followerFrequencies(members, counts)
+		}
+	}
+	if found == nil {
+		found = fallback
+	}
+	return found, nil
+}
+
+// followerFrequencies assigns counts to followers, the ones learned before counting have count 1
+func followerFrequencies(members []string, counts map[string]int) map[string]int {
+	frequencies := make(map[string]int, len(members))
+	for _, member := range members {
+		frequencies[member] = 1
+		if count, ok := counts[member]; ok && count > 0 {
+			frequencies[member] = count
+		}
+	}
+	return frequencies
+}
+
+type frequency struct {
+	word   string
+	count  int
+	weight float64
+}
+
+// sampleFollower picks a follower using r from [0, 1): stop is skipped if it is not allowed yet
+// (and there is anything else), only TopK most frequent followers are considered,
+// weighted by count^(1/Temperature) (Temperature 0 means the most frequent one), and only the most frequent ones
+// covering TopP of the total weight are kept. Mirrors samplingWalkScript.
+func sampleFollower(followers map[string]int, canStop bool, s settings, r float64) string {
+	var candidates []frequency
+	for word, count := range followers {
+		if canStop || word != stop || len(followers) == 1 {
+			candidates = append(candidates, frequency{word: word, count: count})
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].count != candidates[j].count {
+			return candidates[i].count > candidates[j].count
+		}
+		return candidates[i].word < candidates[j].word
+	})
+	if s.Temperature <= 0 {
+		// the limit of sharper and sharper distributions
+		return candidates[0].word
+	}
+	if s.TopK > 0 && int64(len(candidates)) > s.TopK {
+		candidates = candidates[:s.TopK]
+	}
+
+	total := 0.0
+	for i := range candidates {
+		// relative to the most frequent follower to avoid overflow
+		candidates[i].weight = math.Pow(float64(candidates[i].count)/float64(candidates[0].count), 1/s.Temperature)
+		total += candidates[i].weight
+	}
+	if s.TopP > 0 && s.TopP < 1 {
+		sum, kept := 0.0, 0
+		for i, c := range candidates {
+			sum, kept = sum+c.weight, i+1
+			if sum >= s.TopP*total {
+				break
+			}
+		}
+		candidates, total = candidates[:kept], sum
+	}
+
+	r *= total
+	for _, c := range candidates {
+		if r < c.weight {
+			return c.word
+		}
+		r -= c.weight
+	}
+	return candidates[len(candidates)-1].word
+}
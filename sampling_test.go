@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSampleFollower(t *testing.T) {
+	followers := map[string]int{"cat": 6, "dog": 3, "fish": 1, stop: 10}
+	sample := func(s settings, canStop bool) map[string]bool {
+		picked := make(map[string]bool)
+		for r := 0.0; r < 1; r += 0.001 {
+			picked[sampleFollower(followers, canStop, s, r)] = true
+		}
+		return picked
+	}
+
+	if picked := sample(settings{Temperature: 1}, true); len(picked) != 4 {
+		t.Errorf("sampling should pick every follower: %v", picked)
+	}
+	if picked := sample(settings{Temperature: 1, MinLength: 5}, false); picked[stop] || len(picked) != 3 {
+		t.Errorf("stop should be skipped when it is not allowed yet: %v", picked)
+	}
+	if sampleFollower(map[string]int{stop: 1}, false, settings{}, 0.5) != stop {
+		t.Error("stop should be picked when there is nothing else")
+	}
+	if picked := sample(settings{Temperature: 1, TopK: 2}, false); !reflect.DeepEqual(picked, map[string]bool{"cat": true, "dog": true}) {
+		t.Errorf("TopK should keep the most frequent followers: %v", picked)
+	}
+	if picked := sample(settings{Temperature: 1, TopP: 0.6}, false); !reflect.DeepEqual(picked, map[string]bool{"cat": true}) {
+		t.Errorf("TopP should keep the most frequent followers covering the probability: %v", picked)
+	}
+
+	// with Temperature 1 "cat" is picked for r < 0.6, sharper distribution makes it more likely
+	if sampleFollower(followers, false, settings{Temperature: 1}, 0.65) != "dog" {
+		t.Error("Temperature 1 should follow learned frequencies")
+	}
+	if sampleFollower(followers, false, settings{Temperature: 0.5}, 0.65) != "cat" {
+		t.Error("low Temperature should prefer frequent followers")
+	}
+	if picked := sample(settings{Temperature: 0}, false); !reflect.DeepEqual(picked, map[string]bool{"cat": true}) {
+		t.Errorf("Temperature 0 should pick the most frequent follower: %v", picked)
+	}
+	if picked := sample(settings{Temperature: 0.01}, false); !reflect.DeepEqual(picked, map[string]bool{"cat": true}) {
+		t.Errorf("Temperature close to 0 should pick the most frequent follower: %v", picked)
+	}
+	if sampleFollower(map[string]int{}, true, settings{}, 0.5) != "" {
+		t.Error("sampleFollower should return empty string without followers")
+	}
+}
+
+func TestFollowerFrequencies(t *testing.T) {
+	frequencies := followerFrequencies([]string{"cat", "dog"}, map[string]int{"cat": 3, "fish": 2})
+	if !reflect.DeepEqual(frequencies, map[string]int{"cat": 3, "dog": 1}) {
+		t.Errorf("followerFrequencies returned %v", frequencies)
+	}
+}
+
+func TestMinWords(t *testing.T) {
+	if left := minWords([]string{start, "hello"}, settings{MinLength: 5}); left != 4 {
+		t.Errorf("minWords should not count markers, returned %d", left)
+	}
+	if left := minWords([]string{"hello", "kitty"}, settings{MinLength: 1}); left != 0 {
+		t.Errorf("minWords returned %d for a long enough chain", left)
+	}
+}
+
+func TestParseSettings(t *testing.T) {
+	override, err := parseSettings(url.Values{"temperature": {"1.5"}, "topK": {"3"}})
+	if err != nil || *override.Temperature != 1.5 || *override.TopK != 3 || override.TopP != nil {
+		t.Errorf("parseSettings returned %+v, %v", override, err)
+	}
+	if _, err := parseSettings(url.Values{"topK": {"-1"}}); err == nil {
+		t.Error("parseSettings should reject negative values")
+	}
+	if _, err := parseSettings(url.Values{"temperature": {"hot"}}); err == nil {
+		t.Error("parseSettings should reject invalid numbers")
+	}
+	if override, err := parseSettings(url.Values{"sampling": {"true"}}); err != nil || !*override.Sampling {
+		t.Errorf("parseSettings returned %+v, %v", override, err)
+	}
+	if _, err := parseSettings(url.Values{"sampling": {"maybe"}}); err == nil {
+		t.Error("parseSettings should reject invalid booleans")
+	}
+}
+
+func TestSamplingEnabled(t *testing.T) {
+	samplingOrig, overridesOrig, generationOrig := config.Sampling, config.ChannelSettings, config.GenerationMode
+	defer func() {
+		config.Sampling, config.ChannelSettings, config.GenerationMode = samplingOrig, overridesOrig, generationOrig
+	}()
+	enabled := true
+
+	config.Sampling, config.ChannelSettings, config.GenerationMode = false, map[string]channelSettings{"#dogs": {}}, walkGeneration
+	if samplingEnabled() || countsFollowers() {
+		t.Error("sampling should not be enabled by default")
+	}
+	config.GenerationMode = beamGeneration
+	if samplingEnabled() || !countsFollowers() {
+		t.Error("beam search should enable counting of followers without sampling")
+	}
+	config.GenerationMode = walkGeneration
+	config.ChannelSettings["#cats"] = channelSettings{Sampling: &enabled}
+	if !samplingEnabled() || !countsFollowers() {
+		t.Error("sampling in a single channel should enable counting of followers")
+	}
+}
+
+func TestSettingsHandler(t *testing.T) {
+	samplingOrig, temperatureOrig, tokenOrig := config.Sampling, config.Temperature, config.SettingsToken
+	defer func() {
+		config.Sampling, config.Temperature, config.SettingsToken = samplingOrig, temperatureOrig, tokenOrig
+		runtimeSettingsMtx.Lock()
+		delete(runtimeSettings, "#cats")
+		runtimeSettingsMtx.Unlock()
+	}()
+	config.Sampling, config.Temperature, config.SettingsToken = false, 1, ""
+
+	request := func(body string) *http.Request {
+		request := httptest.NewRequest("POST", "/settings?channel=%23Cats", strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return request
+	}
+	send := func(request *http.Request) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		settingsHandler(recorder, request)
+		return recorder
+	}
+	if recorder := send(request("temperature=2")); recorder.Code != http.StatusForbidden {
+		t.Errorf("settingsHandler should reject changes from other hosts without a token, returned %d", recorder.Code)
+	}
+	config.SettingsToken = "secret"
+	authorized := request("temperature=3")
+	authorized.Header.Set("Authorization", "Bearer secret")
+	if recorder := send(authorized); recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"Temperature": 3`) {
+		t.Errorf("settingsHandler should accept changes with the token, returned %d: %s", recorder.Code, recorder.Body.String())
+	}
+	config.SettingsToken = ""
+
+	post := func(body string) *httptest.ResponseRecorder {
+		local := request(body)
+		local.RemoteAddr = "127.0.0.1:12345"
+		return send(local)
+	}
+	if recorder := post("temperature=2"); recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"Temperature": 2`) {
+		t.Errorf("settingsHandler returned %d: %s", recorder.Code, recorder.Body.String())
+	}
+	post("topK=3&sampling=1")
+	s := settingsFor("#cats")
+	if s.Temperature != 2 || s.TopK != 3 || !s.sampling() {
+		t.Errorf("runtime settings should be merged and applied: %+v", s)
+	}
+	if settingsFor("#dogs").sampling() {
+		t.Error("runtime settings should not leak to other channels")
+	}
+	if recorder := post("topP=x"); recorder.Code != http.StatusBadRequest {
+		t.Errorf("settingsHandler should reject invalid values, returned %d", recorder.Code)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+)
+
+// how the response is selected from scored candidates
+const (
+	selectRandom  = "random"  // uniformly, ignoring scores
+	selectArgmax  = "argmax"  // the best one
+	selectSoftmax = "softmax" // randomly, the better the more likely (see SelectionTemperature)
+)
+
+// scoredCandidate is a response candidate with its total score and scores of every scorer
+type scoredCandidate struct {
+	Text       string             `json:"text"`
+	Score      float64            `json:"score"`
+	Components map[string]float64 `json:"components"`
+}
+
+// scoring is what scorers know about the input and the corpus
+type scoring struct {
+	salient   []string       // salient words of the input
+	followers map[string]int // number of followers of chain keys used by candidates
+	recent    [][]string     // words of recent responses in the channel
+}
+
+// scorer rates a candidate (tokens of the response), the result is multiplied
+// by the weight from ScoreWeights, scorers without weight are not used
+type scorer func(candidate []string, s *scoring) float64
+
+var scorers = map[string]scorer{
+	"overlap":    overlapScore,
+	"verbatim":   verbatimScore,
+	"repetition": repetitionScore,
+	"length":     lengthScore,
+	"novelty":    noveltyScore,
+}
+
+// overlapScore is the share of salient input words present in the candidate
+func overlapScore(candidate []string, s *scoring) float64 {
+	if len(s.salient) == 0 {
+		return 0
+	}
+	found := 0
+	for _, word := range s.salient {
+		if contains(candidate, word) {
+			found++
+		}
+	}
+	return float64(found) / float64(len(s.salient))
+}
+
+// verbatimScore is the (negative) share of transitions which had just one follower in the corpus:
+// the candidate copies a learned sentence when there was no choice at any step
+func verbatimScore(candidate []string, s *scoring) float64 {
+	keys := chainKeys(candidate)
+	if len(keys) == 0 {
+		return 0
+	}
+	forced := 0
+	for _, key := range keys {
+		if s.followers[key] == 1 {
+			forced++
+		}
+	}
+	return -float64(forced) / float64(len(keys))
+}
+
+// repetitionScore is the (negative) share of repeated words
+func repetitionScore(candidate []string, s *scoring) float64 {
+	seen := make(map[string]bool)
+	words, repeated := 0, 0
+	for _, token := range candidate {
+		if isPunctuation(token) {
+			continue
+		}
+		words++
+		if seen[token] {
+			repeated++
+		}
+		seen[token] = true
+	}
+	if words == 0 {
+		return 0
+	}
+	return -float64(repeated) / float64(words)
+}
+
+// lengthScore is 1 for candidates of TargetLength words, and decreases with the distance from it
+func lengthScore(candidate []string, s *scoring) float64 {
+	length, target := float64(len(candidate)), float64(config.TargetLength)
+	return 1 - math.Abs(length-target)/math.Max(length, target)
+}
+
+// noveltyScore is the (negative) highest similarity to one of recent responses in the channel
+func noveltyScore(candidate []string, s *scoring) float64 {
+	return -maxSimilarity(candidate, s.recent)
+}
+
+// salientWords skips markers, punctuation, short words and words listed in DontEndWith (they are function words)
+func salientWords(input []string) []string {
+	var salient []string
+	for _, word := range input {
+		if word == start || word == stop || isPunctuation(word) || utf8.RuneCountInString(word) < 3 ||
+			contains(config.DontEndWith, word) || contains(salient, word) {
+			continue
+		}
+		salient = append(salient, word)
+	}
+	return salient
+}
+
+// chainKeys returns keys of chains traversed to build the candidate
+func chainKeys(candidate []string) []string {
+	var keys []string
+	for _, seed := range createSeeds(candidate) {
+		keys = append(keys, strings.Join(seed[:len(seed)-1], separator))
+	}
+	return keys
+}
+
+// followerCounts asks for the number of followers of all keys in one round-trip
+func followerCounts(keys []string) map[string]int {
+	counts := make(map[string]int)
+	if len(keys) == 0 {
+		return counts
+	}
+	corpus := pool.Get()
+	defer corpus.Close()
+	for _, key := range keys {
+		corpus.Send("SCARD", key)
+	}
+	if err := corpus.Flush(); err != nil {
+		redisErr(err)
+		return counts
+	}
+	for _, key := range keys {
+		count, err := redis.Int(corpus.Receive())
+		if err != nil {
+			redisErr(err)
+			return counts
+		}
+		counts[key] = count
+	}
+	return counts
+}
+
+// scoreCandidates rates candidates and sorts them from the best one
+func scoreCandidates(texts []string, input []string, recentTokens [][]string) []scoredCandidate {
+	s := &scoring{salient: salientWords(input), recent: recentTokens}
+	if config.ScoreWeights["verbatim"] != 0 {
+		var keys []string
+		for _, text := range texts {
+			for _, key := range chainKeys(strings.Split(text, " ")) {
+				if !contains(keys, key) {
+					keys = append(keys, key)
+				}
+			}
+		}
+		s.followers = followerCounts(keys)
+	}
+
+	candidates := make([]scoredCandidate, 0, len(texts))
+	for _, text := range texts {
+		tokens := strings.Split(text, " ")
+		candidate := scoredCandidate{Text: text, Components: make(map[string]float64)}
+		for name, weight := range config.ScoreWeights {
+			if score, ok := scorers[name]; ok && weight != 0 {
+				component := score(tokens, s)
+				candidate.Components[name] = component
+				candidate.Score += weight * component
+			}
+		}
+		candidates = append(candidates, candidate)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].Score != candidates[j].Score {
+			return candidates[i].Score > candidates[j].Score
+		}
+		return candidates[i].Text < candidates[j].Text
+	})
+
+	if config.Debug {
+		for _, c := range candidates {
+			log.Println("score " + fmt.Sprintf("%.3f", c.Score) + " " + fmt.Sprint(c.Components) + ":\t" + c.Text)
+		}
+	}
+	return candidates
+}
+
+// selectCandidate picks the response from candidates sorted by scoreCandidates according to SelectionPolicy
+func selectCandidate(candidates []scoredCandidate) scoredCandidate {
+	switch config.SelectionPolicy {
+	case selectArgmax:
+		return candidates[0]
+	case selectSoftmax:
+		weights := make([]float64, len(candidates))
+		total := 0.0
+		for i, c := range candidates {
+			// shifted by the best score to avoid overflow
+			weights[i] = math.Exp((c.Score - candidates[0].Score) / config.SelectionTemperature)
+			total += weights[i]
+		}
+		r := rand.Float64() * total
+		for i, weight := range weights {
+			if r < weight {
+				return candidates[i]
+			}
+			r -= weight
+		}
+		return candidates[len(candidates)-1]
+	default:
+		return candidates[rand.Intn(len(candidates))]
+	}
+}
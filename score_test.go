@@ -0,0 +1,87 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSalientWords(t *testing.T) {
+	input := parseInput("what do you think about kubernetes, kubernetes?")
+	expected := []string{"what", "you", "think", "about", "kubernetes"}
+	if salient := salientWords(input); !reflect.DeepEqual(salient, expected) {
+		t.Error("salientWords returned " + dump(salient) + " instead of " + dump(expected))
+	}
+}
+
+func TestScorers(t *testing.T) {
+	targetOrig := config.TargetLength
+	config.TargetLength = 4
+	defer func() { config.TargetLength = targetOrig }()
+
+	s := &scoring{
+		salient:   []string{"cats", "dogs"},
+		followers: map[string]int{"i" + separator + "like": 1, "like" + separator + "cats": 3},
+	}
+	test := func(name string, candidate string, expected float64) {
+		if score := scorers[name](strings.Split(candidate, " "), s); math.Abs(score-expected) > 0.001 {
+			t.Errorf("%s(%q) should be %.3f, got %.3f", name, candidate, expected, score)
+		}
+	}
+	test("overlap", "i like cats", 0.5)
+	test("overlap", "i like cats and dogs", 1)
+	test("overlap", "i like birds", 0)
+	test("verbatim", "i like cats", -1)
+	test("verbatim", "i like cats and", -0.5)
+	test("verbatim", "you like birds", 0)
+	test("repetition", "cats cats cats , !", -2.0/3)
+	test("repetition", "i like cats", 0)
+	test("length", "i like cats too", 1)
+	test("length", "i like", 0.5)
+	test("length", "i like cats and dogs , really .", 0.5)
+}
+
+func TestSelectCandidate(t *testing.T) {
+	policyOrig, temperatureOrig, weightsOrig := config.SelectionPolicy, config.SelectionTemperature, config.ScoreWeights
+	defer func() {
+		config.SelectionPolicy, config.SelectionTemperature, config.ScoreWeights = policyOrig, temperatureOrig, weightsOrig
+	}()
+
+	config.ScoreWeights = map[string]float64{"overlap": 1}
+	candidates := scoreCandidates([]string{"i like birds", "i like cats", "cats and dogs"}, parseInput("cats or dogs?"), nil)
+	if candidates[0].Text != "cats and dogs" || candidates[2].Text != "i like birds" {
+		t.Errorf("scoreCandidates should sort candidates from the best one: %v", candidates)
+	}
+
+	config.SelectionPolicy = selectArgmax
+	if selectCandidate(candidates).Text != "cats and dogs" {
+		t.Error("argmax should select the best candidate")
+	}
+
+	config.SelectionPolicy = selectSoftmax
+	config.SelectionTemperature = 0.01
+	for i := 0; i < 10; i++ {
+		if selectCandidate(candidates).Text != "cats and dogs" {
+			t.Error("softmax with low temperature should select the best candidate")
+		}
+	}
+	config.SelectionTemperature = 1000
+	selected := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		selected[selectCandidate(candidates).Text] = true
+	}
+	if len(selected) != len(candidates) {
+		t.Error("softmax with high temperature should select any candidate")
+	}
+}
+
+func TestExplainHandlerRequiresMessage(t *testing.T) {
+	w := httptest.NewRecorder()
+	explainHandler(w, httptest.NewRequest("GET", "/explain", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Error("explain without message should be rejected, got ", w.Code)
+	}
+}
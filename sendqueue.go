@@ -0,0 +1,182 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// IRC line limit (RFC 1459), including trailing CR-LF
+	ircMaxLine = 512
+	// space reserved for nick!user@host prefix added by the server when relaying our messages
+	ircMaxPrefix = 1 + 30 + 1 + 10 + 1 + 63
+	// oldest messages are dropped when queue grows above this size
+	maxQueuedMessages = 64
+)
+
+type outgoing struct {
+	target string
+	text   string
+	action bool
+}
+
+// tokenBucket limits the rate of outgoing messages while allowing short bursts
+type tokenBucket struct {
+	capacity float64
+	tokens   float64
+	rate     float64 // tokens per second
+	last     time.Time
+}
+
+func newTokenBucket(capacity float64, rate float64, now time.Time) *tokenBucket {
+	return &tokenBucket{capacity: capacity, tokens: capacity, rate: rate, last: now}
+}
+
+// take consumes a token and returns zero if one is available,
+// otherwise returns how long to wait before trying again
+func (b *tokenBucket) take(now time.Time) time.Duration {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// sendQueue paces outgoing messages of a single connection
+type sendQueue struct {
+	mtx     sync.Mutex
+	items   []outgoing
+	wake    chan struct{}
+	done    chan struct{}
+	bucket  *tokenBucket
+	send    func(outgoing)
+	allowed func(target string) bool
+}
+
+func newSendQueue(send func(outgoing), allowed func(target string) bool) *sendQueue {
+	q := &sendQueue{
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		bucket:  newTokenBucket(float64(config.IrcFloodBurst), config.IrcFloodRate, time.Now()),
+		send:    send,
+		allowed: allowed,
+	}
+	go q.loop()
+	return q
+}
+
+// push splits text into lines fitting the IRC limit and queues them
+func (q *sendQueue) push(target string, text string, action bool, nick string) {
+	max := ircMaxLine - 2 - ircMaxPrefix - len(nick) - len("PRIVMSG  :") - len(target)
+	if action {
+		max -= len("\x01ACTION \x01")
+	}
+	q.mtx.Lock()
+	for _, line := range splitMessage(text, max) {
+		q.items = append(q.items, outgoing{target: target, text: line, action: action})
+	}
+	if dropped := len(q.items) - maxQueuedMessages; dropped > 0 {
+		log.Warn("Send queue is full, dropping ", dropped, " oldest messages")
+		q.items = q.items[dropped:]
+	}
+	q.mtx.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// drop removes messages queued for the target (eg. after leaving a channel)
+func (q *sendQueue) drop(target string) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	items := q.items[:0]
+	for _, item := range q.items {
+		if !strings.EqualFold(item.target, target) {
+			items = append(items, item)
+		}
+	}
+	q.items = items
+}
+
+func (q *sendQueue) stop() {
+	select {
+	case <-q.done:
+	default:
+		close(q.done)
+	}
+}
+
+func (q *sendQueue) loop() {
+	for {
+		item, ok := q.next()
+		if !ok {
+			select {
+			case <-q.done:
+				return
+			case <-q.wake:
+			}
+			continue
+		}
+		if !q.allowed(item.target) {
+			if config.Debug {
+				log.Println("Dropping message to " + item.target + ": not joined anymore")
+			}
+			continue
+		}
+		for wait := q.bucket.take(time.Now()); wait > 0; wait = q.bucket.take(time.Now()) {
+			select {
+			case <-q.done:
+				return
+			case <-time.After(wait):
+			}
+		}
+		q.send(item)
+	}
+}
+
+func (q *sendQueue) next() (outgoing, bool) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if len(q.items) == 0 {
+		return outgoing{}, false
+	}
+	item := q.items[0]
+	q.items = q.items[1:]
+	return item, true
+}
+
+// splitMessage splits text into lines of at most max bytes,
+// breaking at word boundaries and never in the middle of UTF-8 sequence
+func splitMessage(text string, max int) []string {
+	var lines []string
+	for len(text) > max {
+		cut := strings.LastIndex(text[:max+1], " ")
+		if cut <= 0 {
+			// single word longer than the limit
+			cut = max
+			for cut > 0 && !utf8.RuneStart(text[cut]) {
+				cut--
+			}
+			if cut == 0 {
+				_, cut = utf8.DecodeRuneInString(text)
+			}
+		}
+		lines = append(lines, strings.TrimSpace(text[:cut]))
+		text = strings.TrimSpace(text[cut:])
+	}
+	if text != "" {
+		lines = append(lines, text)
+	}
+	return lines
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(0, 0)
+	bucket := newTokenBucket(2, 0.5, now)
+
+	// burst
+	if bucket.take(now) != 0 || bucket.take(now) != 0 {
+		t.Error("tokenBucket should allow a burst up to its capacity")
+	}
+	if wait := bucket.take(now); wait != 2*time.Second {
+		t.Errorf("tokenBucket should ask to wait 2s for the next token, got %v", wait)
+	}
+	// refill
+	now = now.Add(2 * time.Second)
+	if bucket.take(now) != 0 {
+		t.Error("tokenBucket should refill over time")
+	}
+	// capacity is never exceeded
+	now = now.Add(time.Hour)
+	if bucket.take(now) != 0 || bucket.take(now) != 0 || bucket.take(now) == 0 {
+		t.Error("tokenBucket should not store more tokens than its capacity")
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	test := func(text string, max int, expected []string) {
+		lines := splitMessage(text, max)
+		if !reflect.DeepEqual(lines, expected) {
+			t.Error("splitMessage should return " + dump(expected) + " but got " + dump(lines))
+		}
+		for _, line := range lines {
+			if (len(line) > max && utf8.RuneCountInString(line) > 1) || !utf8.ValidString(line) {
+				t.Error("splitMessage returned invalid line: " + line)
+			}
+		}
+	}
+	test("short text", 100, []string{"short text"})
+	test("one two three four", 9, []string{"one two", "three", "four"})
+	test("one two three four", 7, []string{"one two", "three", "four"})
+	test("abcdefghij", 4, []string{"abcd", "efgh", "ij"})
+	test("żółć żółć", 5, []string{"żó", "łć", "żó", "łć"})
+	test("żółć", 1, []string{"ż", "ó", "ł", "ć"})
+	test("", 10, []string(nil))
+}
+
+func TestSendQueue(t *testing.T) {
+	var (
+		mtx  sync.Mutex
+		sent []outgoing
+	)
+	done := make(chan struct{})
+	queue := newSendQueue(func(m outgoing) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		sent = append(sent, m)
+		if len(sent) == 3 {
+			close(done)
+		}
+	}, func(target string) bool {
+		return target != "#left"
+	})
+	defer queue.stop()
+
+	queue.push("#left", "never sent", false, "meowkov")
+	queue.push("#test", "hello", false, "meowkov")
+	queue.push("nick", "waves", true, "meowkov")
+	queue.push("#test", strings.Repeat("word ", 100), false, "meowkov")
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("sendQueue did not send messages in time")
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	if sent[0].target != "#test" || sent[0].text != "hello" || sent[1].target != "nick" || !sent[1].action {
+		t.Errorf("sendQueue sent unexpected messages: %#v", sent)
+	}
+	if !strings.HasPrefix(sent[2].text, "word word") || len(sent[2].text) > ircMaxLine {
+		t.Errorf("sendQueue should split long messages, got: %q", sent[2].text)
+	}
+}
+
+func TestSendQueueDrop(t *testing.T) {
+	queue := &sendQueue{}
+	queue.items = []outgoing{{target: "#a", text: "1"}, {target: "#b", text: "2"}, {target: "#A", text: "3"}}
+	queue.drop("#a")
+	if len(queue.items) != 1 || queue.items[0].target != "#b" {
+		t.Errorf("sendQueue.drop should remove messages for the target, got: %#v", queue.items)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// channelSettings override global settings in a particular channel (or Matrix room),
+// options missing in the config file are not overridden
+type channelSettings struct {
+	MaxCopiedTokens *int64   `json:",omitempty"`
+	Sampling        *bool    `json:",omitempty"`
+	Temperature     *float64 `json:",omitempty"`
+	TopK            *int64   `json:",omitempty"`
+	TopP            *float64 `json:",omitempty"`
+	MinLength       *int64   `json:",omitempty"`
+}
+
+// settings used during generation of a single response
+type settings struct {
+	Channel         string
+	MaxCopiedTokens int64
+	Sampling        bool    // followers are picked by their frequency, uniformly otherwise (as in older versions)
+	Temperature     float64 // of sampling, 1 = learned frequencies, 0 = the most frequent follower
+	TopK            int64   // only the most frequent followers, 0 = all
+	TopP            float64 // only the most frequent followers covering this probability, 0 = all
+	MinLength       int64   // responses shorter than this should not end (when sampling)
+}
+
+type settingsKey struct{}
+
+var (
+	// overrides set at runtime via /settings, applied after ChannelSettings from the config file
+	runtimeSettings    = make(map[string]channelSettings)
+	runtimeSettingsMtx sync.Mutex
+)
+
+// settingsFor returns global settings with overrides for the channel
+func settingsFor(channel string) settings {
+	s := settings{
+		Channel:         channel,
+		MaxCopiedTokens: config.MaxCopiedTokens,
+		Sampling:        config.Sampling,
+		Temperature:     config.Temperature,
+		TopK:            config.TopK,
+		TopP:            config.TopP,
+		MinLength:       config.MinLength,
+	}
+	if override, ok := config.ChannelSettings[strings.ToLower(channel)]; ok {
+		s.apply(override)
+	}
+	runtimeSettingsMtx.Lock()
+	defer runtimeSettingsMtx.Unlock()
+	if override, ok := runtimeSettings[strings.ToLower(channel)]; ok {
+		s.apply(override)
+	}
+	return s
+}
+
+func (s *settings) apply(override channelSettings) {
+	if override.MaxCopiedTokens != nil {
+		s.MaxCopiedTokens = *override.MaxCopiedTokens
+	}
+	if override.Sampling != nil {
+		s.Sampling = *override.Sampling
+	}
+	if override.Temperature != nil {
+		s.Temperature = *override.Temperature
+	}
+	if override.TopK != nil {
+		s.TopK = *override.TopK
+	}
+	if override.TopP != nil {
+		s.TopP = *override.TopP
+	}
+	if override.MinLength != nil {
+		s.MinLength = *override.MinLength
+	}
+}
+
+// sampling tells if followers should be sampled by frequency instead of uniformly
+func (s settings) sampling() bool {
+	return s.Sampling
+}
+
+// samplingEnabled tells if sampling is enabled globally or in any channel
+func samplingEnabled() bool {
+	if config.Sampling {
+		return true
+	}
+	for _, override := range config.ChannelSettings {
+		if override.Sampling != nil && *override.Sampling {
+			return true
+		}
+	}
+	runtimeSettingsMtx.Lock()
+	defer runtimeSettingsMtx.Unlock()
+	for _, override := range runtimeSettings {
+		if override.Sampling != nil && *override.Sampling {
+			return true
+		}
+	}
+	return false
+}
+
+// withSettings attaches settings to the context of response generation
+func withSettings(ctx context.Context, s settings) context.Context {
+	return context.WithValue(ctx, settingsKey{}, s)
+}
+
+// settingsFrom returns settings attached to ctx, global ones by default
+func settingsFrom(ctx context.Context) settings {
+	if s, ok := ctx.Value(settingsKey{}).(settings); ok {
+		return s
+	}
+	return settingsFor("")
+}
+
+// parseSettings reads overrides from query parameters (eg. ?sampling=true&temperature=1.5&topK=10)
+func parseSettings(query url.Values) (channelSettings, error) {
+	var (
+		override channelSettings
+		err      error
+	)
+	parseInt := func(name string) *int64 {
+		value := query.Get(name)
+		if value == "" || err != nil {
+			return nil
+		}
+		var i int64
+		if i, err = strconv.ParseInt(value, 10, 64); err != nil || i < 0 {
+			err = errors.New("invalid '" + name + "': " + value)
+			return nil
+		}
+		return &i
+	}
+	parseFloat := func(name string) *float64 {
+		value := query.Get(name)
+		if value == "" || err != nil {
+			return nil
+		}
+		var f float64
+		if f, err = strconv.ParseFloat(value, 64); err != nil || f < 0 {
+			err = errors.New("invalid '" + name + "': " + value)
+			return nil
+		}
+		return &f
+	}
+	if value := query.Get("sampling"); value != "" {
+		sampling, parseErr := strconv.ParseBool(value)
+		if parseErr != nil {
+			return override, errors.New("invalid 'sampling': " + value)
+		}
+		override.Sampling = &sampling
+	}
+	override.MaxCopiedTokens = parseInt("maxCopiedTokens")
+	override.Temperature = parseFloat("temperature")
+	override.TopK = parseInt("topK")
+	override.TopP = parseFloat("topP")
+	override.MinLength = parseInt("minLength")
+	return override, err
+}
+
+// settingsHandler serves /settings?channel=…: GET returns settings used in the channel,
+// POST with parameters (eg. temperature=1.5) overrides them until restart
+// (authorized with SettingsToken, or only from loopback if there is none)
+func settingsHandler(w http.ResponseWriter, r *http.Request) {
+	channel := r.FormValue("channel")
+	switch r.Method {
+	case "GET":
+	case "POST":
+		if !mayChangeSettings(r) {
+			http.Error(w, "changing settings requires 'Authorization: Bearer <SettingsToken>'", http.StatusForbidden)
+			return
+		}
+		override, err := parseSettings(r.Form)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		runtimeSettingsMtx.Lock()
+		current := runtimeSettings[strings.ToLower(channel)]
+		runtimeSettings[strings.ToLower(channel)] = mergeSettings(current, override)
+		runtimeSettingsMtx.Unlock()
+	default:
+		http.Error(w, "use GET or POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(settingsFor(channel))
+}
+
+// mayChangeSettings tells if the request carries SettingsToken,
+// without a token only requests from loopback are allowed
+func mayChangeSettings(r *http.Request) bool {
+	if config.SettingsToken != "" {
+		expected := "Bearer " + config.SettingsToken
+		return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) == 1
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// mergeSettings returns overrides with values set in next replacing the ones in current
+func mergeSettings(current channelSettings, next channelSettings) channelSettings {
+	if next.MaxCopiedTokens != nil {
+		current.MaxCopiedTokens = next.MaxCopiedTokens
+	}
+	if next.Sampling != nil {
+		current.Sampling = next.Sampling
+	}
+	if next.Temperature != nil {
+		current.Temperature = next.Temperature
+	}
+	if next.TopK != nil {
+		current.TopK = next.TopK
+	}
+	if next.TopP != nil {
+		current.TopP = next.TopP
+	}
+	if next.MinLength != nil {
+		current.MinLength = next.MinLength
+	}
+	return current
+}
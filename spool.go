@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+)
+
+// spooledLesson is a set of seeds that could not be added to the corpus
+type spooledLesson struct {
+	Time    int64      `json:"t"` // unix time of the failed write
+	Seeds   [][]string `json:"s"`
+	Message string     `json:"m,omitempty"` // learned line, for casing and parrot index (see learnLesson)
+	seq     int64
+}
+
+// spool is a bounded write-ahead queue of lessons kept on disk while Redis is unreachable.
+// Lessons are appended to a file (one JSON object per line) and replayed once Redis recovers.
+type spool struct {
+	mtx     sync.Mutex
+	path    string
+	max     int
+	lessons []spooledLesson
+	seq     int64
+	dropped int64
+}
+
+var corpusSpool *spool
+
+// openSpool loads lessons left in the spool file by previous run
+func openSpool(path string, max int) (*spool, error) {
+	s := &spool{path: path, max: max}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var lesson spooledLesson
+		if err := json.Unmarshal(scanner.Bytes(), &lesson); err != nil {
+			log.Warn("Skipping corrupted line in spool " + path + ": " + err.Error())
+			continue
+		}
+		s.seq++
+		lesson.seq = s.seq
+		s.lessons = append(s.lessons, lesson)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(s.lessons) > 0 {
+		log.Info("Found " + fmt.Sprint(len(s.lessons)) + " lessons waiting in spool " + path)
+	}
+	if len(s.lessons) > s.max {
+		s.trim()
+		err = s.rewrite()
+	}
+	return s, err
+}
+
+// add appends lesson to the spool, dropping the oldest ones when spool is full
+func (s *spool) add(seeds [][]string, message string) {
+	lesson := spooledLesson{Time: time.Now().Unix(), Seeds: seeds, Message: message}
+	line, err := json.Marshal(lesson)
+	if err != nil {
+		log.Error("Unable to spool lesson: ", err)
+		return
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.seq++
+	lesson.seq = s.seq
+	s.lessons = append(s.lessons, lesson)
+	if len(s.lessons) > s.max {
+		s.trim()
+		err = s.rewrite()
+	} else {
+		err = s.append(line)
+	}
+	if err != nil {
+		log.Error("Unable to write spool "+s.path+": ", err)
+	}
+}
+
+// replay passes spooled lessons to store (oldest first) until it fails,
+// returns the number of replayed lessons
+func (s *spool) replay(store func(seeds [][]string, message string) error) int {
+	s.mtx.Lock()
+	pending := make([]spooledLesson, len(s.lessons))
+	copy(pending, s.lessons)
+	s.mtx.Unlock()
+
+	var (
+		replayed int
+		last     int64
+	)
+	for _, lesson := range pending {
+		if err := store(lesson.Seeds, lesson.Message); err != nil {
+			if config.Debug {
+				log.Println("Replaying spool interrupted: " + err.Error())
+			}
+			break
+		}
+		replayed++
+		last = lesson.seq
+	}
+	if replayed == 0 {
+		return 0
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	// lessons could be trimmed or added in the meantime, so remove by sequence number
+	i := 0
+	for i < len(s.lessons) && s.lessons[i].seq <= last {
+		i++
+	}
+	s.lessons = s.lessons[i:]
+	if err := s.rewrite(); err != nil {
+		log.Error("Unable to write spool "+s.path+": ", err)
+	}
+	log.Info("Replayed " + fmt.Sprint(replayed) + " spooled lessons, " + fmt.Sprint(len(s.lessons)) + " left")
+	return replayed
+}
+
+// replayLoop periodically tries to move spooled lessons to the corpus
+func (s *spool) replayLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		if s.size() > 0 {
+			s.replay(learnLesson)
+		}
+	}
+}
+
+// stats returns the number of spooled lessons and the age of the oldest one
+func (s *spool) stats() (int, time.Duration) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if len(s.lessons) == 0 {
+		return 0, 0
+	}
+	return len(s.lessons), time.Since(time.Unix(s.lessons[0].Time, 0))
+}
+
+func (s *spool) size() int {
+	size, _ := s.stats()
+	return size
+}
+
+// droppedLessons returns the number of lessons dropped because the spool was full
+func (s *spool) droppedLessons() int64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.dropped
+}
+
+func (s *spool) trim() {
+	dropped := len(s.lessons) - s.max
+	s.dropped += int64(dropped)
+	log.Warn("Spool is full, dropping " + fmt.Sprint(dropped) + " oldest lessons")
+	s.lessons = s.lessons[dropped:]
+}
+
+func (s *spool) append(line []byte) error {
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// rewrite replaces spool file with lessons kept in memory
+func (s *spool) rewrite() error {
+	if len(s.lessons) == 0 {
+		err := os.Remove(s.path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	for _, lesson := range s.lessons {
+		line, _ := json.Marshal(lesson)
+		writer.Write(append(line, '\n'))
+	}
+	err = writer.Flush()
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// isConnectionErr tells apart Redis being unreachable from errors returned by Redis itself
+// (the latter would fail again on replay)
+func isConnectionErr(err error) bool {
+	_, reply := err.(redis.Error)
+	return err != nil && !reply
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func tempSpool(t *testing.T, max int) (*spool, string, func()) {
+	dir, err := ioutil.TempDir("", "meowkov-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "meowkov.spool")
+	s, err := openSpool(path, max)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, path, func() { os.RemoveAll(dir) }
+}
+
+func TestSpoolSurvivesRestart(t *testing.T) {
+	s, path, cleanup := tempSpool(t, 10)
+	defer cleanup()
+
+	s.add([][]string{{"a", "b", "c"}}, "a b c")
+	s.add([][]string{{"d", "e", stop}}, "")
+
+	reopened, err := openSpool(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size, _ := reopened.stats(); size != 2 {
+		t.Error("spool should keep 2 lessons after restart, got ", size)
+	}
+	if reopened.lessons[1].Seeds[0][2] != stop || reopened.lessons[0].Message != "a b c" {
+		t.Error("spooled seeds should be restored as they were added")
+	}
+}
+
+func TestSpoolIsBounded(t *testing.T) {
+	s, path, cleanup := tempSpool(t, 2)
+	defer cleanup()
+
+	s.add([][]string{{"1"}}, "")
+	s.add([][]string{{"2"}}, "")
+	s.add([][]string{{"3"}}, "")
+	if len(s.lessons) != 2 || s.lessons[0].Seeds[0][0] != "2" || s.droppedLessons() != 1 {
+		t.Error("spool should drop the oldest lesson when full")
+	}
+	reopened, _ := openSpool(path, 2)
+	if len(reopened.lessons) != 2 || reopened.lessons[0].Seeds[0][0] != "2" {
+		t.Error("spool file should be trimmed as well")
+	}
+}
+
+func TestSpoolReplay(t *testing.T) {
+	s, path, cleanup := tempSpool(t, 10)
+	defer cleanup()
+
+	s.add([][]string{{"1"}}, "")
+	s.add([][]string{{"2"}}, "")
+	s.add([][]string{{"3"}}, "")
+
+	var stored []string
+	down := errors.New("connection refused")
+	replayed := s.replay(func(seeds [][]string, message string) error {
+		if len(stored) == 2 {
+			return down // Redis went away again
+		}
+		stored = append(stored, seeds[0][0])
+		return nil
+	})
+	if replayed != 2 || s.size() != 1 || s.lessons[0].Seeds[0][0] != "3" {
+		t.Error("replay should stop at first failure and keep the rest, replayed ", replayed)
+	}
+
+	s.replay(func(seeds [][]string, message string) error { return nil })
+	if s.size() != 0 {
+		t.Error("spool should be empty after successful replay")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("empty spool should not leave a file behind")
+	}
+}
+
+func TestSpoolReplayIndexesLines(t *testing.T) {
+	defer scratchCorpus(t)()
+	indexOrig := config.ParrotIndex
+	defer func() { config.ParrotIndex = indexOrig }()
+	config.ParrotIndex = true
+	s, _, cleanup := tempSpool(t, 10)
+	defer cleanup()
+
+	// learned during an outage
+	message := "the quick brown fox jumps over the lazy dog"
+	words := parseInput(message)
+	s.add(learnedSeeds(words, createSeeds(words)), message)
+	if replayed := s.replay(learnLesson); replayed != 1 {
+		t.Fatal("replay should learn the spooled lesson, replayed ", replayed)
+	}
+
+	tokens := withoutMarkers(words)
+	windows := tokenWindows(tokens, int(config.ParrotWindow))
+	lines, err := windowLines(windows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make([][]string, len(windows))
+	for i, window := range windows {
+		found[i] = lines[window]
+	}
+	if copied := longestCopy(found, int(config.ParrotWindow)); copied != len(tokens) {
+		t.Errorf("replayed line should be indexed, longestCopy found %d of %d tokens", copied, len(tokens))
+	}
+}
+
+func TestIsConnectionErr(t *testing.T) {
+	if isConnectionErr(nil) {
+		t.Error("nil is not a connection error")
+	}
+	if isConnectionErr(redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value")) {
+		t.Error("error replies from Redis should not be spooled")
+	}
+	if !isConnectionErr(errors.New("dial tcp: connection refused")) {
+		t.Error("network errors should be spooled")
+	}
+}
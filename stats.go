@@ -0,0 +1,43 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// runtime statistics are published via expvar and served as JSON at /debug/vars
+func init() {
+	expvar.Publish("spool", expvar.Func(spoolStats))
+	expvar.Publish("cache", expvar.Func(cacheStats))
+}
+
+func cacheStats() interface{} {
+	if followers == nil {
+		return nil
+	}
+	return followers.stats()
+}
+
+func spoolStats() interface{} {
+	if corpusSpool == nil {
+		return nil
+	}
+	size, age := corpusSpool.stats()
+	return map[string]interface{}{
+		"size":       size,
+		"ageSeconds": int64(age.Seconds()),
+		"dropped":    corpusSpool.droppedLessons(),
+	}
+}
+
+// serveStats starts HTTP server with statistics (expvar registers its handler in http.DefaultServeMux)
+// and explanations of responses
+func serveStats(address string) {
+	http.HandleFunc("/explain", explainHandler)
+	http.HandleFunc("/settings", settingsHandler)
+	log.Info("Serving stats at http://" + address + "/debug/vars, explanations at http://" + address + "/explain?message=… and settings at http://" + address + "/settings?channel=…")
+	err := http.ListenAndServe(address, nil)
+	log.Error("Stats server stopped: ", err)
+}
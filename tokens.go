@@ -0,0 +1,303 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// split from the beginning of words
+	openingPunctuation = `„“"'([`
+	// split from the end of words, runs like "?!" or "..." become a single token
+	sentencePunctuation = `.?!…`
+	closingPunctuation  = `”“"')],;:`
+	// hash with counts of surface forms (casing) of a word, can't collide with chains
+	casingPrefix = start + "case" + separator
+
+	// what to do with responses having unbalanced quotes or brackets
+	repairUnbalanced = "repair"
+	rejectUnbalanced = "reject"
+)
+
+// casingScript counts surface forms of words: ARGV = casingPrefix, (normalized word, surface form)...
+var casingScript = redis.NewScript(0, `
+for i = 2, #ARGV, 2 do
+	redis.call('HINCRBY', ARGV[1] .. ARGV[i], ARGV[i + 1], 1)
+end
+`)
+
+// tokenize splits message into words and punctuation tokens, keeping the original casing
+func tokenize(message string) []string {
+	var tokens []string
+	for _, field := range strings.Fields(ircFormatting.ReplaceAllString(message, "")) {
+		tokens = append(tokens, splitPunctuation(field)...)
+	}
+	return tokens
+}
+
+// "(hello?!)" → ["(" "hello" "?!" ")"]
+func splitPunctuation(word string) []string {
+	if httpLink.MatchString(word) || emoticonCruft.MatchString(word) {
+		return []string{word}
+	}
+
+	var head []string
+	for len(word) > 0 {
+		r, size := utf8.DecodeRuneInString(word)
+		if !strings.ContainsRune(openingPunctuation, r) {
+			break
+		}
+		head = append(head, word[:size])
+		word = word[size:]
+	}
+
+	var tail []string
+	for len(word) > 0 {
+		r, size := utf8.DecodeLastRuneInString(word)
+		before := word
+		switch {
+		case strings.ContainsRune(sentencePunctuation, r):
+			for len(word) > 0 {
+				if r, size = utf8.DecodeLastRuneInString(word); !strings.ContainsRune(sentencePunctuation, r) {
+					break
+				}
+				word = word[:len(word)-size]
+			}
+		case r == '\'' && !contains(head, "'"):
+			// apostrophe of a plural possessive ("cats'"), not a quote the word did not open
+		case strings.ContainsRune(closingPunctuation, r):
+			word = word[:len(word)-size]
+		}
+		if word == before {
+			break
+		}
+		tail = append([]string{before[len(word):]}, tail...)
+	}
+
+	tokens := head
+	if word != "" {
+		tokens = append(tokens, word)
+	}
+	return append(tokens, tail...)
+}
+
+func isPunctuation(token string) bool {
+	return token != "" && strings.Trim(token, openingPunctuation+sentencePunctuation+closingPunctuation) == ""
+}
+
+// pairs of quotes and brackets, “ is the closing quote of „ (eg. in Polish) and the opening one otherwise.
+// ' is not balanced, a quote spanning several words can't be told apart from an apostrophe
+var punctuationPairs = map[string]string{
+	"(": ")",
+	"[": "]",
+	"„": "“",
+	"“": "”",
+	`"`: `"`,
+}
+
+// balancePunctuation repairs unbalanced quotes and brackets in response:
+// closing ones without a pair are removed, the opened ones are closed (before final punctuation),
+// empty pairs are removed. Returns false if anything had to be repaired.
+func balancePunctuation(words []string) ([]string, bool) {
+	var (
+		result   []string
+		open     []int // positions of unclosed openings in result
+		balanced = true
+	)
+	// closeLast closes the most recently opened pair, or removes its opening if there is nothing inside
+	closeLast := func() {
+		last := open[len(open)-1]
+		open = open[:len(open)-1]
+		if last == len(result)-1 {
+			result = result[:last]
+		} else {
+			result = append(result, punctuationPairs[result[last]])
+		}
+	}
+
+	for _, word := range words {
+		if i := matchingOpening(result, open, word); i >= 0 {
+			for len(open)-1 > i { // pairs opened inside have to be closed first
+				closeLast()
+				balanced = false
+			}
+			if open[i] == len(result)-1 {
+				balanced = false
+			}
+			closeLast()
+			continue
+		}
+		if _, opening := punctuationPairs[word]; opening {
+			open = append(open, len(result))
+			result = append(result, word)
+			continue
+		}
+		if word == ")" || word == "]" || word == "”" {
+			balanced = false // nothing to close
+			continue
+		}
+		result = append(result, word)
+	}
+
+	if len(open) > 0 {
+		balanced = false
+		end := len(result)
+		for end > 0 && strings.Trim(result[end-1], sentencePunctuation) == "" {
+			end--
+		}
+		tail := append([]string{}, result[end:]...)
+		result = result[:end]
+		for len(open) > 0 {
+			closeLast()
+		}
+		result = append(result, tail...)
+	}
+	return result, balanced
+}
+
+// matchingOpening returns position in open of the opening closed by word, or -1
+func matchingOpening(result []string, open []int, word string) int {
+	for i := len(open) - 1; i >= 0; i-- {
+		if punctuationPairs[result[open[i]]] == word {
+			return i
+		}
+	}
+	return -1
+}
+
+// isDangling tells if response should not end with the token
+func isDangling(token string) bool {
+	return token == "," || token == ";" || token == ":"
+}
+
+// learnCasing counts surface forms of words, skipping the first words of sentences
+// (which are capitalized anyway)
+func learnCasing(tokens []string) {
+	args := redis.Args{}.Add(casingPrefix)
+	sentenceStart := true
+	for _, token := range tokens {
+		if isPunctuation(token) {
+			sentenceStart = sentenceStart || strings.ContainsAny(token, sentencePunctuation)
+			continue
+		}
+		if !sentenceStart && !httpLink.MatchString(token) {
+			if word := normalizeWord(token); word != "" {
+				args = args.Add(word, token)
+			}
+		}
+		sentenceStart = false
+	}
+	if len(args) == 1 {
+		return
+	}
+
+	corpus := pool.Get()
+	defer corpus.Close()
+	if _, err := casingScript.Do(corpus, args...); err != nil {
+		redisErr(err)
+	}
+}
+
+// detokenize turns response tokens back into natural text,
+// restoring the most common casing of words and attaching punctuation to words
+func detokenize(tokens []string) string {
+	forms := surfaceForms(tokens)
+	text := make([]string, len(tokens))
+	for i, token := range tokens {
+		if form, ok := forms[token]; ok {
+			token = form
+		}
+		text[i] = token
+	}
+	return joinTokens(text)
+}
+
+// surfaceForms returns the most common casing of words (words never seen in the middle of a sentence keep their casing)
+func surfaceForms(tokens []string) map[string]string {
+	forms := make(map[string]string)
+	var words []string
+	for _, token := range tokens {
+		if _, seen := forms[token]; !seen && !isPunctuation(token) && !httpLink.MatchString(token) {
+			forms[token] = token
+			words = append(words, token)
+		}
+	}
+	if len(words) == 0 {
+		return forms
+	}
+
+	corpus := pool.Get()
+	defer corpus.Close()
+	for _, word := range words {
+		corpus.Send("HGETALL", casingPrefix+word)
+	}
+	if err := corpus.Flush(); err != nil {
+		redisErr(err)
+		return forms
+	}
+	for _, word := range words {
+		counts, err := redis.IntMap(corpus.Receive())
+		if err != nil {
+			redisErr(err)
+			return forms
+		}
+		if form := mostCommonForm(counts); form != "" {
+			forms[word] = form
+		}
+	}
+	return forms
+}
+
+// mostCommonForm returns surface form with the highest count (lexically first on ties)
+func mostCommonForm(counts map[string]int) string {
+	var (
+		best  string
+		count int
+	)
+	for form, c := range counts {
+		if c > count || (c == count && form < best) {
+			best, count = form, c
+		}
+	}
+	return best
+}
+
+// joinTokens joins tokens with spaces, except after opening and before closing punctuation
+func joinTokens(tokens []string) string {
+	var (
+		text     []string
+		glue     = true // no space before the first token
+		openings = map[string]bool{}
+	)
+	for _, token := range tokens {
+		opening, closing := false, false
+		switch {
+		case token == `"` || token == "'":
+			// straight quotes close the last opened one
+			closing = openings[token]
+			opening = !closing
+			openings[token] = opening
+		case token == "“":
+			// closes „ (eg. in Polish), opens otherwise
+			closing = openings["„"]
+			opening = !closing
+			openings["„"] = false
+		case token == "„":
+			opening = true
+			openings[token] = true
+		case isPunctuation(token):
+			r, _ := utf8.DecodeRuneInString(token)
+			opening = strings.ContainsRune(openingPunctuation, r)
+			closing = !opening
+		}
+
+		if !glue && !closing {
+			text = append(text, " ")
+		}
+		text = append(text, token)
+		glue = opening
+	}
+	return strings.Join(text, "")
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	test := func(input string, expected ...string) {
+		if tokens := tokenize(input); !reflect.DeepEqual(tokens, expected) {
+			t.Error("tokenize(" + input + ") returned " + dump(tokens) + " instead of " + dump(expected))
+		}
+	}
+	test("Hello, World!", "Hello", ",", "World", "!")
+	test("\"foo\" 'bar'", "\"", "foo", "\"", "'", "bar", "'")
+	test(" (foo) [bar ", "(", "foo", ")", "[", "bar")
+	test("f\"oo f'oo f(oo f[oo", "f\"oo", "f'oo", "f(oo", "f[oo")
+	test("foo!?!?!? foo!?bar", "foo", "!?!?!?", "foo!?bar")
+	test("„foo” “bar”", "„", "foo", "”", "“", "bar", "”")
+	test("wait... what?", "wait", "...", "what", "?")
+	test("see: https://example.com/?a=1.", "see", ":", "https://example.com/?a=1.")
+	test(":-((( ;'< :-Pppp", ":-(((", ";'<", ":-Pppp")
+	test("\x02bold\x02 \x0304,12red\x03 \x1funderline", "bold", "red", "underline")
+
+	// quotes and brackets are split from beginning and/or end, but not from the inside
+	test(" \"foo", "\"", "foo")
+	test(" foo\" ", "foo", "\"")
+	test(" \"foo\" ", "\"", "foo", "\"")
+	test(" f\"oo ", "f\"oo")
+	test(" 'foo", "'", "foo")
+	test(" foo' ", "foo'")
+	test(" 'foo' ", "'", "foo", "'")
+	test(" f'oo ", "f'oo")
+	test(" 'foo'. ", "'", "foo", "'", ".")
+	// plural possessives keep their apostrophe
+	test("the cats' toys are here", "the", "cats'", "toys", "are", "here")
+	test("it's the dogs' bowl.", "it's", "the", "dogs'", "bowl", ".")
+	test(" (foo)", "(", "foo", ")")
+	test(" (foo ", "(", "foo")
+	test(" foo) ", "foo", ")")
+	test(" f(oo ", "f(oo")
+	test(" [foo]", "[", "foo", "]")
+	test(" [foo ", "[", "foo")
+	test(" foo] ", "foo", "]")
+	test(" f[oo ", "f[oo")
+
+	// ? and ! are split from the end only
+	test(" foo? ", "foo", "?")
+	test(" foo! ", "foo", "!")
+	test(" foo!?!?!? ", "foo", "!?!?!?")
+	test(" foo!?bar ", "foo!?bar")
+	test(" “foo” ", "“", "foo", "”")
+	test(" „foo” ", "„", "foo", "”")
+}
+
+func TestJoinTokens(t *testing.T) {
+	test := func(expected string, tokens ...string) {
+		if text := joinTokens(tokens); text != expected {
+			t.Error("joinTokens(" + dump(tokens) + ") returned >" + text + "< instead of >" + expected + "<")
+		}
+	}
+	test("Hello, World!", "Hello", ",", "World", "!")
+	test("he said \"meow\" (twice).", "he", "said", "\"", "meow", "\"", "(", "twice", ")", ".")
+	test("'a' 'b'", "'", "a", "'", "'", "b", "'")
+	test("powiedział „miau“ i “meow” wait...", "powiedział", "„", "miau", "“", "i", "“", "meow", "”", "wait", "...")
+	test("/me purrs", "/me", "purrs")
+}
+
+func TestMostCommonForm(t *testing.T) {
+	if form := mostCommonForm(map[string]int{"nasa": 1, "NASA": 5, "Nasa": 2}); form != "NASA" {
+		t.Error("mostCommonForm should return the most common casing, got " + form)
+	}
+	if form := mostCommonForm(map[string]int{"Go": 2, "go": 2}); form != "Go" {
+		t.Error("mostCommonForm should be deterministic on ties, got " + form)
+	}
+	if form := mostCommonForm(nil); form != "" {
+		t.Error("mostCommonForm should return empty string without forms")
+	}
+}
+
+func TestIsPunctuation(t *testing.T) {
+	for _, token := range []string{",", "?!", "...", "(", "”"} {
+		if !isPunctuation(token) {
+			t.Error(token + " should be punctuation")
+		}
+	}
+	for _, token := range []string{"", "a", "don't", "/me"} {
+		if isPunctuation(token) {
+			t.Error(token + " should not be punctuation")
+		}
+	}
+}
+
+func TestBalancePunctuation(t *testing.T) {
+	test := func(input string, expected string, expectedBalanced bool) {
+		words, balanced := balancePunctuation(tokenize(input))
+		if output := joinTokens(words); output != expected || balanced != expectedBalanced {
+			t.Errorf("balancePunctuation(%q) returned %q (balanced: %v) instead of %q (%v)", input, output, balanced, expected, expectedBalanced)
+		}
+	}
+	test("he said (quietly) \"meow\".", "he said (quietly) \"meow\".", true)
+	test("„miau“ i “meow”", "„miau“ i “meow”", true)
+	test("he said (quietly", "he said (quietly)", false)
+	test("he said (quietly.", "he said (quietly).", false)
+	test("he said \"meow (twice?!", "he said \"meow (twice)\"?!", false)
+	test("quietly) he said", "quietly he said", false)
+	test("he said ( ) meow", "he said meow", false)
+	test("he said (", "he said", false)
+	test("(he [said) meow", "(he [said]) meow", false)
+	test("he ] said ”", "he said", false)
+	test("\"a (b\" c)", "\"a (b)\" c", false)
+	test("the cats' toys are here", "the cats' toys are here", true)
+	test("it's the dogs' bowl", "it's the dogs' bowl", true)
+	test("'quietly' he said 'meow now'", "'quietly' he said 'meow now'", true)
+	test("", "", true)
+}
+
+func TestPostprocess(t *testing.T) {
+	policyOrig := config.UnbalancedPunctuation
+	defer func() { config.UnbalancedPunctuation = policyOrig }()
+
+	config.UnbalancedPunctuation = repairUnbalanced
+	if output := postprocess([]string{"(", "meow"}); !reflect.DeepEqual(output, []string{"(", "meow", ")"}) {
+		t.Errorf("postprocess should repair unbalanced brackets, got %q", output)
+	}
+	config.UnbalancedPunctuation = rejectUnbalanced
+	if output := postprocess([]string{"(", "meow"}); output != nil {
+		t.Errorf("postprocess should reject unbalanced brackets, got %q", output)
+	}
+	if output := postprocess([]string{"(", "meow", ")"}); len(output) != 3 {
+		t.Errorf("postprocess should keep balanced brackets, got %q", output)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// message is a single line of text received by a transport
+type message struct {
+	source     string // channel or nick the response should be sent to
+	nick       string // author of the message
+	text       string
+	private    bool // true if message was sent directly to the bot
+	learn      bool // true if message should be added to the corpus
+	receivedAt time.Time
+}
+
+// transport connects the bot to a chat network (IRC, local console, ...)
+type transport interface {
+	// run connects and blocks until the connection is finished,
+	// passing every incoming message to the handler
+	run(handle func(message)) error
+	// current nick of the bot
+	nick() string
+	// send plain text message
+	message(target string, text string)
+	// send action (/me)
+	action(target string, text string)
+	// disconnect from the network
+	close()
+}
+
+// exit code used when a transport gives up (eg. unable to reconnect)
+const exitTransportFailed = 2
+
+// chatLoop runs transports until one of them finishes or process is terminated
+func chatLoop(transports ...transport) {
+	// proces termination signal triggers cleanup, second one terminates immediately
+	sc := make(chan os.Signal, 2)
+	signal.Notify(sc, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	if exitCode, stopped := runChat(newProcessor(int(config.Workers)), transports, sc, saveCorpus); stopped {
+		os.Exit(exitCode)
+	}
+}
+
+// runChat passes messages from transports to the processor until one of transports finishes
+// or a signal is received. Shutdown (including saving the corpus) happens before it returns,
+// in that case it returns the exit code and true.
+func runChat(p *processor, transports []transport, signals chan os.Signal, save func() int) (int, bool) {
+	finished := make(chan error, len(transports))
+	for _, t := range transports {
+		go func(t transport) {
+			finished <- t.run(func(m message) {
+				p.dispatch(t, m)
+			})
+		}(t)
+	}
+
+	select {
+	case sig := <-signals:
+		log.Warn("Received '", sig, "' signal, shutting down")
+		go func() {
+			sig := <-signals
+			log.Error("Received '", sig, "' signal during shutdown, exiting immediately")
+			os.Exit(1)
+		}()
+		return shutdown(p, transports, 0, save), true
+	case err := <-finished:
+		if err != nil {
+			log.Error("The chat loop finished prematurely: ", err)
+			return shutdown(p, transports, exitTransportFailed, save), true
+		}
+	}
+	p.drain()
+	return 0, false
+}
+
+// shutdown stops accepting messages, gives pending responses ShutdownTimeout to finish
+// (then cancels them), flushes learning queue, disconnects all transports
+// and persists the corpus, returns the exit code
+func shutdown(p *processor, transports []transport, exitCode int, save func() int) int {
+	p.shutdown(time.Duration(config.ShutdownTimeout) * time.Second)
+	for _, t := range transports {
+		t.close()
+	}
+	if save() != 0 && exitCode == 0 {
+		exitCode = 1
+	}
+	return exitCode
+}
+
+// thin wrapper responsible for sending responses via transport
+func reply(ctx context.Context, t transport, m message, text string, prefixWithNick bool) {
+	response := strings.TrimSpace(text)
+	typingDelay(ctx, response, m.receivedAt)
+	if strings.HasPrefix(response, "/me ") {
+		t.action(m.source, strings.Replace(response, "/me ", "", 1))
+	} else {
+		if prefixWithNick {
+			response = m.nick + ": " + response
+		}
+		t.message(m.source, response)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	clientWalk = "client"
+	serverWalk = "server"
+)
+
+// walkScript performs random walks inside Redis, so a whole batch of candidate chains
+// costs a single round-trip instead of one SRANDMEMBER per generated word.
+// Mirrors randomBranch: ARGV = order, max length, number of walks, separator, stop, seed words...
+// (chain keys are computed on the fly, so this is not compatible with Redis Cluster)
+var walkScript = redis.NewScript(0, `
+local order = tonumber(ARGV[1])
+local maxLength = tonumber(ARGV[2])
+local walks = tonumber(ARGV[3])
+local separator = ARGV[4]
+local stop = ARGV[5]
+local results = {}
+for w = 1, walks do
+	local response = {}
+	for i = 1, order do
+		response[i] = ARGV[5 + i]
+	end
+	for i = 1, maxLength do
+		local key = table.concat(response, separator, #response - order + 1, #response)
+		local word = redis.call('SRANDMEMBER', key)
+		if not word or word == '' or word == stop then
+			break
+		end
+		response[#response + 1] = word
+	end
+	results[w] = table.concat(response, separator)
+end
+return results
+`)
+
+// backoffWalkScript is walkScript for variable-order corpus (see backoffBranch),
+// ARGV = max length, number of walks, separator, stop, MinFollowers, number of orders, orders..., seed words...
+var backoffWalkScript = redis.NewScript(0, `
+local maxLength = tonumber(ARGV[1])
+local walks = tonumber(ARGV[2])
+local separator = ARGV[3]
+local stop = ARGV[4]
+local minFollowers = tonumber(ARGV[5])
+local orderCount = tonumber(ARGV[6])
+local orders = {}
+for i = 1, orderCount do
+	orders[i] = tonumber(ARGV[6 + i])
+end
+local results = {}
+for w = 1, walks do
+	local response = {}
+	for i = 7 + orderCount, #ARGV do
+		response[#response + 1] = ARGV[i]
+	end
+	for i = 1, maxLength do
+		local word, fallback = nil, nil
+		for _, order in ipairs(orders) do
+			if order <= #response then
+				local key = table.concat(response, separator, #response - order + 1, #response)
+				local count = redis.call('SCARD', key)
+				if count >= minFollowers then
+					word = redis.call('SRANDMEMBER', key)
+					break
+				elseif count > 0 and not fallback then
+					fallback = key
+				end
+			end
+		end
+		if not word and fallback then
+			word = redis.call('SRANDMEMBER', fallback)
+		end
+		if not word or word == '' or word == stop then
+			break
+		end
+		response[#response + 1] = word
+	end
+	results[w] = table.concat(response, separator)
+end
+return results
+`)
+
+// randomBranches returns up to n random walks starting at the chain of words
+// (words joined with spaces, see postprocess)
+func randomBranches(ctx context.Context, words []string, n int) []string {
+	if s := settingsFrom(ctx); s.sampling() {
+		return samplingBranches(ctx, words, n, s)
+	}
+	if config.WalkMode == serverWalk {
+		branches, err := serverRandomBranches(words, n)
+		if err == nil {
+			return branches
+		}
+		redisErr(err)
+		if config.Debug {
+			log.Println("Server-side walk failed, falling back to client-side walk")
+		}
+	}
+
+	walk := randomBranch
+	if len(config.ChainLengths) > 1 {
+		walk = backoffBranch
+	}
+	var branches []string
+	for i := 0; i < n && ctx.Err() == nil; i++ {
+		branches = append(branches, walk(ctx, words))
+	}
+	return branches
+}
+
+func serverRandomBranches(words []string, n int) ([]string, error) {
+	corpus := pool.Get()
+	defer corpus.Close()
+
+	script := walkScript
+	args := redis.Args{}.Add(config.ChainLength, config.MaxChainLength, n, separator, stop)
+	if len(config.ChainLengths) > 1 {
+		script = backoffWalkScript
+		args = redis.Args{}.Add(config.MaxChainLength, n, separator, stop, config.MinFollowers, len(config.ChainLengths))
+		for _, order := range config.ChainLengths {
+			args = args.Add(order)
+		}
+	}
+	for _, word := range words[:config.ChainLength] {
+		args = args.Add(word)
+	}
+	walks, err := redis.Strings(script.Do(corpus, args...))
+	if err != nil {
+		return nil, err
+	}
+
+	branches := make([]string, 0, len(walks))
+	for _, walk := range walks {
+		branches = append(branches, strings.Join(strings.Split(walk, separator), " "))
+	}
+	return branches, nil
+}
+
+// backoffBranch is randomBranch for variable-order corpus (several ChainLengths):
+// every next word follows the longest chain (last words of the response) having at least
+// MinFollowers followers, backing off to shorter chains
+func backoffBranch(ctx context.Context, words []string) string {
+	corpus := pool.Get()
+	defer corpus.Close()
+
+	response := append([]string{}, words[:config.ChainLength]...)
+	for i := 0; i < int(config.MaxChainLength) && ctx.Err() == nil; i++ {
+		word, err := backoffWord(corpus, response)
+		if err != nil {
+			redisErr(err)
+			break
+		}
+		if isEmpty(word) {
+			break
+		}
+		response = append(response, word)
+	}
+	return strings.Join(response, " ")
+}
+
+// backoffWord asks for follower count and a random follower of chains of every order in one round-trip
+// (with the cache enabled, whole follower sets of keys that are not cached yet)
+func backoffWord(corpus redis.Conn, history []string) (string, error) {
+	var keys []string
+	for _, order := range config.ChainLengths {
+		if int(order) <= len(history) {
+			keys = append(keys, strings.Join(history[len(history)-int(order):], separator))
+		}
+	}
+
+	counts := make([]int64, len(keys))
+	words := make([]string, len(keys))
+	cached := make([]bool, len(keys))
+	pending := false
+	for i, key := range keys {
+		if values, ok := followers.get(key); ok {
+			counts[i], words[i], cached[i] = int64(len(values)), randomFollower(values), true
+			continue
+		}
+		if followers != nil {
+			corpus.Send("SMEMBERS", key)
+		} else {
+			corpus.Send("SCARD", key)
+			corpus.Send("SRANDMEMBER", key)
+		}
+		pending = true
+	}
+	if !pending {
+		return backoff(counts, words, config.MinFollowers), nil
+	}
+	if err := corpus.Flush(); err != nil {
+		return "", err
+	}
+
+	for i, key := range keys {
+		if cached[i] {
+			continue
+		}
+		if followers != nil {
+			values, err := redis.Strings(corpus.Receive())
+			if err != nil {
+				return "", err
+			}
+			followers.put(key, values)
+			counts[i], words[i] = int64(len(values)), randomFollower(values)
+			continue
+		}
+		count, err := redis.Int64(corpus.Receive())
+		if err != nil {
+			return "", err
+		}
+		word, err := redis.String(corpus.Receive())
+		if err != nil && err != redis.ErrNil {
+			return "", err
+		}
+		counts[i], words[i] = count, word
+	}
+	return backoff(counts, words, config.MinFollowers), nil
+}
+
+// backoff picks the follower of the longest order with at least min followers,
+// or of the longest order with any followers (counts and words are ordered from the longest order)
+func backoff(counts []int64, words []string, min int64) string {
+	fallback := ""
+	for i, count := range counts {
+		if count >= min {
+			return words[i]
+		}
+		if count > 0 && fallback == "" {
+			fallback = words[i]
+		}
+	}
+	return fallback
+}
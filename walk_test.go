@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	words := []string{"four", "three", "two", "one"}
+	test := func(counts []int64, expected string) {
+		if output := backoff(counts, words, 2); output != expected {
+			t.Errorf("backoff(%v) should return %q, got %q", counts, expected, output)
+		}
+	}
+	test([]int64{5, 1, 3, 7}, "four")
+	test([]int64{1, 0, 2, 7}, "two")
+	test([]int64{0, 1, 1, 1}, "three")
+	test([]int64{0, 0, 0, 0}, "")
+}
+
+// scratchCorpus points pool at empty scratch Redis from MEOWKOV_TEST_REDIS (database 15 is flushed),
+// tests and benchmarks using it are skipped without it
+func scratchCorpus(tb testing.TB) func() {
+	address := os.Getenv("MEOWKOV_TEST_REDIS")
+	if address == "" {
+		tb.Skip("set MEOWKOV_TEST_REDIS=host:port to run tests and benchmarks against Redis")
+	}
+	serverOrig, dbOrig, poolOrig, spoolOrig := config.RedisServer, config.RedisDatabase, pool, corpusSpool
+	config.RedisServer, config.RedisDatabase = address, 15
+	pool = newRedisPool()
+	corpusSpool = nil
+	purgeCorpus()
+
+	return func() {
+		purgeCorpus()
+		pool.Close()
+		config.RedisServer, config.RedisDatabase, pool, corpusSpool = serverOrig, dbOrig, poolOrig, spoolOrig
+	}
+}
+
+// benchCorpus is scratchCorpus filled with some chains
+func benchCorpus(b *testing.B) func() {
+	restore := scratchCorpus(b)
+	for i := 0; i < 100; i++ {
+		processInput("the quick brown fox jumps over the lazy dog and the quick cat jumps over the brown fox", true)
+		processInput("the lazy cat sleeps all day and the quick dog runs over the hill all day long", true)
+	}
+	return restore
+}
+
+func benchmarkRandomBranches(b *testing.B, mode string) {
+	defer benchCorpus(b)()
+	modeOrig := config.WalkMode
+	config.WalkMode = mode
+	defer func() { config.WalkMode = modeOrig }()
+
+	_, seeds := processInput("the quick brown", false)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		randomBranches(context.Background(), seeds[0], int(config.ChainsToTry))
+	}
+}
+
+func BenchmarkRandomBranchesClient(b *testing.B) {
+	benchmarkRandomBranches(b, clientWalk)
+}
+
+func BenchmarkRandomBranchesServer(b *testing.B) {
+	benchmarkRandomBranches(b, serverWalk)
+}
+
+func TestDeadEndWalk(t *testing.T) {
+	followersOrig, lengthOrig := followers, config.ChainLength
+	defer func() { followers, config.ChainLength = followersOrig, lengthOrig }()
+	config.ChainLength = 2
+
+	// "the cat" was never followed by anything
+	followers = newFollowerCache(100, time.Minute)
+	followers.put("the"+separator+"cat", []string{})
+	seed := []string{"the", "cat", "sleeps"}
+	if walk := strings.Fields(randomBranch(context.Background(), seed)); pastSeed(walk) {
+		t.Errorf("walk from a dead-end seed should not get past the seed: %v", walk)
+	}
+	followers.put("the"+separator+"cat", []string{"sleeps"})
+	followers.put("cat"+separator+"sleeps", []string{stop})
+	if walk := strings.Fields(randomBranch(context.Background(), seed)); !pastSeed(walk) {
+		t.Errorf("walk with followers should get past the seed: %v", walk)
+	}
+}
+
+func TestSingleAndMultiOrderWalksEndTheSame(t *testing.T) {
+	followersOrig, lengthsOrig, lengthOrig := followers, config.ChainLengths, config.ChainLength
+	defer func() { followers, config.ChainLengths, config.ChainLength = followersOrig, lengthsOrig, lengthOrig }()
+	config.ChainLength = 2
+	config.ChainLengths = []int64{2, 1}
+
+	// every chain has a single follower, so walks are deterministic (and served from cache)
+	followers = newFollowerCache(100, time.Minute)
+	words := parseInput("the cat sleeps all day")
+	for _, seed := range learnedSeeds(words, createSeeds(words)) {
+		key := strings.Join(seed[:len(seed)-1], separator)
+		cached, _ := followers.get(key)
+		followers.put(key, append(cached, seed[len(seed)-1]))
+	}
+
+	single := randomBranch(context.Background(), words)
+	multi := backoffBranch(context.Background(), words)
+	expected := strings.Join(words[:len(words)-1], " ")
+	if single != expected || multi != expected {
+		t.Errorf("walks should keep the whole chain: single-order %q, multi-order %q, expected %q", single, multi, expected)
+	}
+}